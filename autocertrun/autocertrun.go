@@ -0,0 +1,107 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package autocertrun starts and gracefully shuts down HTTPS servers which
+// obtain their certificates automatically from Let's Encrypt. It lives in its
+// own module so that the core package does not depend on the ACME packages.
+package autocertrun
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/SchumacherFM/runservicerun"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// WithAutoTLS serves the handler via HTTPS at the address and the ACME
+// HTTP-01 challenge at :80, which also redirects all other requests to HTTPS.
+// Certificates get cached in cacheDir and renewed in the background by the
+// autocert.Manager. Obtained certificates get logged via
+// runservicerun.Options.LogInfo.
+func WithAutoTLS(addr string, hostPolicy autocert.HostPolicy, cacheDir string, handler http.Handler) runservicerun.Config {
+	return WithAutoTLSChallengeAddr(addr, ":80", hostPolicy, cacheDir, handler)
+}
+
+// WithAutoTLSChallengeAddr same as WithAutoTLS but serves the ACME HTTP-01
+// challenge at challengeAddr, for example behind a port mapping forwarding
+// port 80 to it.
+func WithAutoTLSChallengeAddr(addr, challengeAddr string, hostPolicy autocert.HostPolicy, cacheDir string, handler http.Handler) runservicerun.Config {
+	srv := &server{}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy,
+		Cache:      logCache{Cache: autocert.DirCache(cacheDir), srv: srv},
+	}
+	srv.https = &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: m.TLSConfig(),
+	}
+	return runservicerun.Configs(
+		runservicerun.WithHTTPHandler(challengeAddr, m.HTTPHandler(nil)),
+		runservicerun.WithServer(addr, srv),
+	)
+}
+
+// server serves HTTPS with the certificates of the autocert.Manager.
+type server struct {
+	https *http.Server
+
+	mu      sync.RWMutex
+	logInfo func(format string, args ...interface{})
+}
+
+func (s *server) SetLog(info, _ func(format string, args ...interface{})) {
+	s.mu.Lock()
+	s.logInfo = info
+	s.mu.Unlock()
+}
+
+func (s *server) log(format string, args ...interface{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.logInfo != nil {
+		s.logInfo(format, args...)
+	}
+}
+
+func (s *server) Serve(lis net.Listener) error {
+	return s.https.ServeTLS(lis, "", "")
+}
+
+func (s *server) Shutdown(ctx context.Context) error {
+	return s.https.Shutdown(ctx)
+}
+
+func (s *server) Close() error {
+	return s.https.Close()
+}
+
+// logCache logs certificates stored in the cache, which happens each time a
+// certificate has been obtained or renewed.
+type logCache struct {
+	autocert.Cache
+	srv *server
+}
+
+func (lc logCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := lc.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	lc.srv.log("autocert stored certificate %q", key)
+	return nil
+}
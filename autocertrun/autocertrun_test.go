@@ -0,0 +1,82 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package autocertrun_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SchumacherFM/runservicerun"
+	"github.com/SchumacherFM/runservicerun/autocertrun"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestWithAutoTLSChallengeAddr(t *testing.T) {
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		autocertrun.WithAutoTLSChallengeAddr("127.0.0.1:0", "localhost:0", autocert.HostWhitelist("example.com"), t.TempDir(), http.NotFoundHandler()),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengeAddr := addrs["localhost:0"].String()
+
+	// the challenge server redirects all other requests to HTTPS
+	client := &http.Client{
+		Transport:     &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get("http://" + challengeAddr + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.Header.Get("Location"), "https://127.0.0.1:443/page"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	// a host not allowed by the policy gets rejected without contacting the
+	// ACME server
+	_, err = tls.Dial("tcp", addrs["127.0.0.1:0"].String(), &tls.Config{ServerName: "example.org", InsecureSkipVerify: true})
+	if err == nil {
+		t.Fatal("expected a handshake error")
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", challengeAddr); err == nil {
+		t.Error("challenge server still listening after the shutdown")
+	}
+}
+
+func TestWithAutoTLSChallengeAddrInUse(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	err = runservicerun.Go(runservicerun.Options{DisableSignals: true},
+		autocertrun.WithAutoTLSChallengeAddr("127.0.0.1:0", lis.Addr().String(), autocert.HostWhitelist("example.com"), t.TempDir(), http.NotFoundHandler()),
+	)
+	if err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("expected the challenge listener to fail, got: %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/SchumacherFM/runservicerun/autocertrun
+
+go 1.26.0
+
+require github.com/SchumacherFM/runservicerun v0.1.0
+
+require (
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sync v0.22.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
@@ -0,0 +1,34 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"database/sql"
+)
+
+// WithDatabase closes the database after shutting down the servers, like
+// WithCloserAfter. With ping set, the database gets pinged as a pre-start
+// function and an unreachable database fails the run before any listener
+// gets bound, see WithPreStart.
+func WithDatabase(name string, db *sql.DB, ping bool) Config {
+	return func(s *services) error {
+		if ping {
+			s.preStarts = append(s.preStarts, named{name: name, startFn: db.PingContext})
+		}
+		s.closersAfter = append(s.closersAfter, named{name: name, closeFn: func(context.Context) error { return db.Close() }})
+		return nil
+	}
+}
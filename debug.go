@@ -0,0 +1,50 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// WithDebugServer serves the net/http/pprof profiles at /debug/pprof/ and the
+// expvar variables at /debug/vars. Exposing them might be sensitive, so bind
+// the address only to a private interface.
+func WithDebugServer(addr string) Config {
+	return WithDebugServerPrefix(addr, "")
+}
+
+// WithDebugServerPrefix same as WithDebugServer but mounts the endpoints below
+// the path prefix, for example "/admin" serves /admin/debug/pprof/.
+func WithDebugServerPrefix(addr, prefix string) Config {
+	return func(s *services) error {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+
+		var handler http.Handler = mux
+		if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+			handler = http.StripPrefix(prefix, mux)
+		}
+		s.servers = append(s.servers, newOwnHTTPServer(newHandlerServer(addr, handler), "", ""))
+		return nil
+	}
+}
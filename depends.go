@@ -0,0 +1,139 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// WithDependsOn registers the servers and closers of c as the node name of a
+// dependency graph. The node depends on the nodes listed in dependsOn, which
+// must be registered with WithDependsOn too. During StepServers, and
+// concurrently to the other servers, each node shuts down once all nodes
+// depending on it have shut down, so dependents stop before their
+// dependencies, for example the API before the cache before the database:
+//
+//	WithDependsOn("db", WithCloserAfter("db", db)),
+//	WithDependsOn("cache", WithCloserAfter("cache", cache), "db"),
+//	WithDependsOn("api", WithHTTPHandler(":8080", api), "cache"),
+//
+// Nodes without a dependency between them shut down concurrently. Unknown
+// dependencies, duplicate names and cycles let Go fail before binding any
+// listener. The servers still start in registration order. Everything else
+// registered by c, like start functions, behaves as without the node.
+func WithDependsOn(name string, c Config, dependsOn ...string) Config {
+	return func(s *services) error {
+		entry, err := applyOrdered(s, c)
+		if err != nil {
+			return err
+		}
+		s.nodes = append(s.nodes, dependencyNode{name: name, dependsOn: dependsOn, entry: entry})
+		return nil
+	}
+}
+
+// dependencyNode contains the servers and closers of WithDependsOn.
+type dependencyNode struct {
+	name      string
+	dependsOn []string
+	entry     sequenceEntry
+}
+
+// validateDependencies checks that all dependencies exist, that the names are
+// unique and that the graph has no cycle.
+func validateDependencies(nodes []dependencyNode) error {
+	byName := make(map[string]dependencyNode, len(nodes))
+	for _, n := range nodes {
+		if _, ok := byName[n.name]; ok {
+			return fmt.Errorf("dependency node %q registered twice", n.name)
+		}
+		byName[n.name] = n
+	}
+	for _, n := range nodes {
+		for _, dep := range n.dependsOn {
+			if _, ok := byName[dep]; !ok {
+				return fmt.Errorf("dependency node %q depends on unknown node %q", n.name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(nodes))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range byName[name].dependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, n := range nodes {
+		if err := visit(n.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdownNodes shuts down each node once all nodes depending on it have shut
+// down. The errors get returned in registration order.
+func shutdownNodes(ctx context.Context, opt Options, rep *reporter, nodes []dependencyNode) []error {
+	done := make(map[string]chan struct{}, len(nodes))
+	dependents := make(map[string][]string, len(nodes))
+	for _, n := range nodes {
+		done[n.name] = make(chan struct{})
+		for _, dep := range n.dependsOn {
+			dependents[dep] = append(dependents[dep], n.name)
+		}
+	}
+	results := make([][]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n dependencyNode) {
+			defer wg.Done()
+			defer close(done[n.name])
+			for _, d := range dependents[n.name] {
+				<-done[d]
+			}
+			results[i] = shutdownSequence(ctx, opt, rep, []sequenceEntry{n.entry})
+		}(i, n)
+	}
+	wg.Wait()
+	var errs []error
+	for _, res := range results {
+		errs = append(errs, res...)
+	}
+	return errs
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DrainRetryAfter defines the Retry-After header sent by DrainMiddleware.
+const DrainRetryAfter = 5 * time.Second
+
+// shuttingDownKey stores the shutdown state of the Runner in the request
+// contexts of the servers created by this package.
+type shuttingDownKey struct{}
+
+// DrainMiddleware responds, once the shutdown has begun, to new requests with
+// 503 Service Unavailable and a Retry-After header of DrainRetryAfter, while
+// requests already being handled finish. It sheds new load even during
+// Options.PreShutdownDelay. It only works for the servers created by this
+// package, for other servers it always calls next.
+func DrainMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sd, ok := r.Context().Value(shuttingDownKey{}).(*atomic.Bool); ok && sd.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(DrainRetryAfter/time.Second)))
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// networkDualStack marks a server listening on IPv4 and IPv6 separately.
+const networkDualStack = "dualstack"
+
+// WithHTTPHandlerDualStack serves the handler on the port of all IPv4
+// addresses, 0.0.0.0, and of all IPv6 addresses, [::], using two separate
+// listeners instead of relying on the dual-stack defaults of the operating
+// system. When one address family is unavailable, the error gets logged and
+// the server listens only on the other one. With port 0 both listeners share
+// the port chosen for IPv4. The server uses DefaultReadHeaderTimeout and
+// DefaultIdleTimeout. Its listeners are not passed on by the graceful restart
+// of Options.EnableGracefulRestart.
+func WithHTTPHandlerDualStack(port int, handler http.Handler) Config {
+	return func(s *services) error {
+		addr := ":" + strconv.Itoa(port)
+		srv := newOwnHTTPServer(newHandlerServer(addr, handler), "", "")
+		srv.network = networkDualStack
+		s.servers = append(s.servers, srv)
+		return nil
+	}
+}
+
+// listenDualStack binds the port on IPv4 and IPv6 and merges both listeners.
+func listenDualStack(ctx context.Context, opt Options, s *server, port string) (net.Listener, error) {
+	listen := func(network, addr string) (net.Listener, error) {
+		if opt.ListenFunc != nil {
+			return opt.ListenFunc(network, addr)
+		}
+		lc := opt.listenConfig()
+		return lc.Listen(ctx, network, addr)
+	}
+
+	var listeners []net.Listener
+	var errs []error
+	lis4, err := listen("tcp4", net.JoinHostPort("0.0.0.0", port))
+	if err == nil {
+		listeners = append(listeners, lis4)
+		if port == "0" {
+			_, port, _ = net.SplitHostPort(lis4.Addr().String())
+		}
+	} else {
+		errs = append(errs, err)
+		logError(opt, logAttrs(LogPhaseStart, s.name, s.addr, err), "server %s failed to listen on IPv4 with error: %s", s.name, err)
+	}
+	lis6, err := listen("tcp6", net.JoinHostPort("::", port))
+	if err == nil {
+		listeners = append(listeners, lis6)
+	} else {
+		errs = append(errs, err)
+		logError(opt, logAttrs(LogPhaseStart, s.name, s.addr, err), "server %s failed to listen on IPv6 with error: %s", s.name, err)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMergedListener(listeners...), nil
+}
+
+// mergedListener accepts the connections of several listeners. Addr returns
+// the address of the first one.
+type mergedListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	once      sync.Once
+}
+
+func newMergedListener(listeners ...net.Listener) *mergedListener {
+	ml := &mergedListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		done:      make(chan struct{}),
+	}
+	for _, lis := range listeners {
+		go ml.accept(lis)
+	}
+	return ml
+}
+
+// accept forwards the connections of lis until it gets closed. Other errors,
+// like running out of file descriptors, get forwarded as well so that the
+// server backs off before accepting again.
+func (ml *mergedListener) accept(lis net.Listener) {
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case ml.errs <- err:
+				continue
+			case <-ml.done:
+				return
+			}
+		}
+		select {
+		case ml.conns <- c:
+		case <-ml.done:
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+func (ml *mergedListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ml.conns:
+		return c, nil
+	case <-ml.done:
+		return nil, net.ErrClosed
+	case err := <-ml.errs:
+		return nil, err
+	}
+}
+
+func (ml *mergedListener) Close() error {
+	var errs []error
+	ml.once.Do(func() {
+		close(ml.done)
+		for _, lis := range ml.listeners {
+			errs = append(errs, lis.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (ml *mergedListener) Addr() net.Addr { return ml.listeners[0].Addr() }
@@ -0,0 +1,60 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ExitCodeShutdownTimeout gets returned by ExitCode when the shutdown did not
+// finish in time. It matches the exit code of timeout(1).
+const ExitCodeShutdownTimeout = 124
+
+// SignalError reports the signal which triggered the shutdown, see
+// Options.ReturnSignalError.
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (se *SignalError) Error() string {
+	return fmt.Sprintf("shutdown triggered by signal: %s", se.Signal)
+}
+
+// ExitCode translates the error returned by Go into an exit code following
+// the Unix conventions: 0 for nil, ExitCodeShutdownTimeout for a
+// *ShutdownTimeoutError or ErrMaxShutdownDuration, 128 plus the signal number
+// for a *SignalError and 1 for any other error, including a
+// context.DeadlineExceeded of a service. For example:
+//
+//	os.Exit(runservicerun.ExitCode(runservicerun.Go(opt, configs...)))
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var te *ShutdownTimeoutError
+	if errors.As(err, &te) || errors.Is(err, ErrMaxShutdownDuration) {
+		return ExitCodeShutdownTimeout
+	}
+	var se *SignalError
+	if errors.As(err, &se) {
+		if sig, ok := se.Signal.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+	return 1
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithFastCGI serves the handler via FastCGI, see net/http/fcgi, on a TCP
+// listener at the address. FastCGI has no graceful shutdown: the shutdown
+// closes the listener, waits for the active requests to finish and then
+// closes the connections to the web server, including those kept open by
+// nginx with fastcgi_keep_conn. A request counts as active once its handler
+// has been called: a request whose records are still arriving gets dropped.
+// Once ShutdownTimeout elapses or the shutdown gets forced, the connections
+// get closed regardless of active requests.
+func WithFastCGI(addr string, handler http.Handler) Config {
+	return func(s *services) error {
+		s.servers = append(s.servers, &server{name: addr, addr: addr, Server: newFCGIServer(handler)})
+		return nil
+	}
+}
+
+// WithFastCGIUnixSocket works like WithFastCGI on a Unix domain socket at path,
+// see WithHTTPUnixSocket.
+func WithFastCGIUnixSocket(path string, handler http.Handler) Config {
+	return func(s *services) error {
+		s.servers = append(s.servers, &server{
+			name:       path,
+			addr:       path,
+			Server:     newFCGIServer(handler),
+			network:    "unix",
+			socketMode: DefaultUnixSocketMode,
+		})
+		return nil
+	}
+}
+
+// fcgiPollInterval defines how often Shutdown checks for active requests.
+const fcgiPollInterval = 10 * time.Millisecond
+
+// fcgiServer implements Server for fcgi.Serve.
+type fcgiServer struct {
+	handler  http.Handler
+	requests atomic.Int64 // requests being handled
+	closing  atomic.Bool
+	served   chan struct{}
+
+	mu    sync.Mutex
+	lis   net.Listener
+	conns map[net.Conn]struct{}
+}
+
+func newFCGIServer(handler http.Handler) *fcgiServer {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	return &fcgiServer{
+		handler: handler,
+		served:  make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *fcgiServer) Serve(lis net.Listener) error {
+	defer close(s.served)
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		_ = lis.Close()
+		return http.ErrServerClosed
+	}
+	s.lis = lis
+	s.mu.Unlock()
+
+	err := fcgi.Serve(&fcgiListener{Listener: lis, srv: s}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		defer s.requests.Add(-1)
+		s.handler.ServeHTTP(w, r)
+	}))
+	if s.closing.Load() {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// stop closes the listener and reports whether Serve has been called.
+func (s *fcgiServer) stop() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing.Store(true)
+	if s.lis == nil {
+		return false
+	}
+	_ = s.lis.Close()
+	return true
+}
+
+// Shutdown closes the listener, waits for the requests being handled and closes
+// all connections, dropping requests not yet passed to the handler.
+func (s *fcgiServer) Shutdown(ctx context.Context) error {
+	if !s.stop() {
+		return nil
+	}
+	select {
+	case <-s.served:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	t := time.NewTicker(fcgiPollInterval)
+	defer t.Stop()
+	for s.requests.Load() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.closeConns()
+	return nil
+}
+
+// Close closes the listener and all connections.
+func (s *fcgiServer) Close() error {
+	s.stop()
+	s.closeConns()
+	return nil
+}
+
+func (s *fcgiServer) closeConns() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// fcgiListener tracks the accepted connections for Close.
+type fcgiListener struct {
+	net.Listener
+	srv *fcgiServer
+}
+
+func (l *fcgiListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &fcgiConn{Conn: c, srv: l.srv}
+	l.srv.mu.Lock()
+	l.srv.conns[tc] = struct{}{}
+	l.srv.mu.Unlock()
+	return tc, nil
+}
+
+type fcgiConn struct {
+	net.Conn
+	srv  *fcgiServer
+	once sync.Once
+}
+
+func (c *fcgiConn) Close() error {
+	c.once.Do(func() {
+		c.srv.mu.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
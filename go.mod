@@ -1,8 +1,9 @@
 module github.com/SchumacherFM/runservicerun
 
-go 1.18
+go 1.26.0
 
 require (
 	github.com/fortytw2/leaktest v1.3.0
 	golang.org/x/sync v0.1.0
+	golang.org/x/sys v0.15.0
 )
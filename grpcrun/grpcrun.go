@@ -0,0 +1,125 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcrun starts and gracefully shuts down gRPC servers with
+// runservicerun. It lives in its own module so that the core package does not
+// depend on gRPC.
+package grpcrun
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/SchumacherFM/runservicerun"
+	"google.golang.org/grpc"
+)
+
+// WithGRPCServer starts the gRPC server at the address. On shutdown it calls
+// GracefulStop, bounded by runservicerun.Options.ShutdownTimeout, and falls
+// back to Stop once the timeout elapses.
+func WithGRPCServer(addr string, srv *grpc.Server) runservicerun.Config {
+	return runservicerun.WithServer(addr, server{Server: srv})
+}
+
+// WithGRPCServerCancelStreams works like WithGRPCServer but cancels the
+// contexts of the streams still active after the grace period, so that
+// GracefulStop completes even when clients keep long-lived streams open. The
+// server must have been created with sc.ServerOption. The trade-off: clients
+// see their streams failing with codes.Canceled instead of ending normally,
+// so they should reconnect. Handlers must return once their stream context is
+// done. Unary calls never get canceled.
+func WithGRPCServerCancelStreams(addr string, srv *grpc.Server, sc *StreamCanceler, grace time.Duration) runservicerun.Config {
+	return runservicerun.WithServer(addr, server{Server: srv, sc: sc, grace: grace})
+}
+
+// StreamCanceler cancels the streams of a gRPC server on shutdown, see
+// WithGRPCServerCancelStreams.
+type StreamCanceler struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewStreamCanceler creates a StreamCanceler.
+func NewStreamCanceler() *StreamCanceler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &StreamCanceler{ctx: ctx, cancel: cancel}
+}
+
+// ServerOption returns the option to pass to grpc.NewServer. It chains a
+// stream interceptor whose stream context gets canceled on shutdown.
+func (sc *StreamCanceler) ServerOption() grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(sc.intercept)
+}
+
+func (sc *StreamCanceler) intercept(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	defer context.AfterFunc(sc.ctx, cancel)()
+	return handler(srv, canceledStream{ServerStream: ss, ctx: ctx})
+}
+
+// canceledStream replaces the context of the stream.
+type canceledStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (cs canceledStream) Context() context.Context {
+	return cs.ctx
+}
+
+type server struct {
+	*grpc.Server
+	sc    *StreamCanceler
+	grace time.Duration
+}
+
+func (s server) Serve(lis net.Listener) error {
+	if err := s.Server.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	return nil
+}
+
+func (s server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	if s.sc != nil {
+		t := time.NewTimer(s.grace)
+		defer t.Stop()
+		select {
+		case <-done:
+			return nil
+		case <-t.C:
+			s.sc.cancel()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s server) Close() error {
+	s.Stop()
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcrun_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SchumacherFM/runservicerun"
+	"github.com/SchumacherFM/runservicerun/grpcrun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestWithGRPCServer(t *testing.T) {
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+
+	addrs := make(chan net.Addr, 1)
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			Signals:         []os.Signal{syscall.SIGUSR1},
+			ShutdownTimeout: time.Second,
+			OnListen:        func(_ string, addr net.Addr) { addrs <- addr },
+		},
+			grpcrun.WithGRPCServer("127.0.0.1:0", srv),
+		)
+	}()
+
+	conn, err := grpc.NewClient((<-addrs).String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.Status, grpc_health_v1.HealthCheckResponse_SERVING; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithGRPCServerCancelStreams(t *testing.T) {
+	sc := grpcrun.NewStreamCanceler()
+	srv := grpc.NewServer(sc.ServerOption())
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+
+	addrs := make(chan net.Addr, 1)
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			Signals:         []os.Signal{syscall.SIGUSR1},
+			ShutdownTimeout: 5 * time.Second,
+			OnListen:        func(_ string, addr net.Addr) { addrs <- addr },
+		},
+			grpcrun.WithGRPCServerCancelStreams("127.0.0.1:0", srv, sc, 50*time.Millisecond),
+		)
+	}()
+
+	conn, err := grpc.NewClient((<-addrs).String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("expected a canceled stream, got: %v", err)
+	}
+}
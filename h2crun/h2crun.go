@@ -0,0 +1,42 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package h2crun starts and gracefully shuts down HTTP/2 cleartext (h2c)
+// servers with runservicerun. It lives in its own module so that the core
+// package does not depend on golang.org/x/net/http2.
+package h2crun
+
+import (
+	"net/http"
+
+	"github.com/SchumacherFM/runservicerun"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// WithH2CHandler serves the handler at the address via HTTP/2 without TLS and
+// via HTTP/1 to clients not supporting it. It gets shut down like the servers
+// of runservicerun.WithHTTPHandler. Open HTTP/2 connections receive a GOAWAY
+// frame on shutdown.
+func WithH2CHandler(addr string, handler http.Handler) runservicerun.Config {
+	h2s := &http2.Server{}
+	hs := &http.Server{
+		Addr:    addr,
+		Handler: h2c.NewHandler(handler, h2s),
+	}
+	// Registers the graceful shutdown of the HTTP/2 connections. It only fails
+	// for an invalid TLSConfig, which hs does not have.
+	_ = http2.ConfigureServer(hs, h2s)
+	return runservicerun.WithHTTPServer(hs)
+}
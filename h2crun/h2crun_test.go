@@ -0,0 +1,73 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package h2crun_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/SchumacherFM/runservicerun"
+	"github.com/SchumacherFM/runservicerun/h2crun"
+	"golang.org/x/net/http2"
+)
+
+func TestWithH2CHandler(t *testing.T) {
+	addrs := make(chan net.Addr, 1)
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			Signals:  []os.Signal{syscall.SIGUSR1},
+			OnListen: func(_ string, addr net.Addr) { addrs <- addr },
+		},
+			h2crun.WithH2CHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, r.Proto)
+			})),
+		)
+	}()
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("http://" + (<-addrs).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(body), "HTTP/2.0"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
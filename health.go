@@ -0,0 +1,56 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// WithHealthEndpoint serves a readiness endpoint at the address and path. It
+// responds with 200 OK once all services are ready and with 503 Service
+// Unavailable as soon as the shutdown begins, which happens before
+// Options.PreShutdownDelay. Load balancers then stop routing requests before
+// the other servers shut down.
+func WithHealthEndpoint(addr, path string) Config {
+	return func(s *services) error {
+		h := &healthHandler{}
+		mux := http.NewServeMux()
+		mux.Handle(path, h)
+		s.servers = append(s.servers, newOwnHTTPServer(newHandlerServer(addr, mux), "", ""))
+		s.onReady = append(s.onReady, func() { h.state.CompareAndSwap(healthStarting, healthReady) })
+		s.onShutdown = append(s.onShutdown, func() { h.state.Store(healthShuttingDown) })
+		return nil
+	}
+}
+
+const (
+	healthStarting int32 = iota
+	healthReady
+	healthShuttingDown
+)
+
+// healthHandler reports whether the services are ready.
+type healthHandler struct {
+	state atomic.Int32
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if h.state.Load() != healthReady {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
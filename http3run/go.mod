@@ -0,0 +1,17 @@
+module github.com/SchumacherFM/runservicerun/http3run
+
+go 1.26.0
+
+require (
+	github.com/SchumacherFM/runservicerun v0.1.0
+	github.com/quic-go/quic-go v0.63.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sync v0.22.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
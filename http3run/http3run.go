@@ -0,0 +1,44 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package http3run starts and gracefully shuts down HTTP/3 (QUIC) servers with
+// runservicerun. It lives in its own module so that the core package does not
+// depend on quic-go.
+package http3run
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/SchumacherFM/runservicerun"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// WithHTTP3Server starts the handler as HTTP/3 server on the UDP address. The
+// certificate gets loaded from the files like runservicerun.WithHTTPHandlerTLS
+// does, a failure gets returned before starting any service. The UDP address
+// gets bound before serving, see runservicerun.WithPacketServer. On shutdown
+// the server gets shut down gracefully, bounded by
+// runservicerun.Options.ShutdownTimeout, and closed afterwards.
+func WithHTTP3Server(addr, certFile, keyFile string, handler http.Handler) runservicerun.Config {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return runservicerun.Maybe(nil, err)
+	}
+	return runservicerun.WithPacketServer(addr, &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	})
+}
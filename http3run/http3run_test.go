@@ -0,0 +1,93 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http3run_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SchumacherFM/runservicerun"
+	"github.com/SchumacherFM/runservicerun/http3run"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestWithHTTP3Server(t *testing.T) {
+	var addr net.Addr
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ShutdownTimeout: time.Second,
+		OnListen:        func(_ string, a net.Addr) { addr = a },
+	},
+		http3run.WithHTTP3Server("127.0.0.1:0", "../testdata/cert.crt", "../testdata/key.pem", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.Proto)
+		})),
+	)
+	if _, err := r.StartAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + addr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(body), "HTTP/3.0"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithHTTP3ServerBindError(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	err = runservicerun.Go(runservicerun.Options{
+		DisableSignals: true,
+		OnReady:        func() { t.Error("OnReady must not be called") },
+	},
+		http3run.WithHTTP3Server(pc.LocalAddr().String(), "../testdata/cert.crt", "../testdata/key.pem", http.NotFoundHandler()),
+	)
+	if !errors.Is(err, runservicerun.ErrStartup) || !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("expected a startup error, got: %v", err)
+	}
+}
+
+func TestWithHTTP3ServerMissingCertificate(t *testing.T) {
+	err := runservicerun.Go(runservicerun.Options{DisableSignals: true},
+		http3run.WithHTTP3Server("127.0.0.1:0", "missing.crt", "missing.pem", http.NotFoundHandler()),
+	)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file, got: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// The stable keys of the attributes logged via Options.Logger.
+const (
+	LogKeyService = "service"
+	LogKeyAddr    = "addr"
+	LogKeyPhase   = "phase"
+	LogKeyErr     = "err"
+)
+
+// The stable values of the LogKeyPhase attribute.
+const (
+	LogPhaseSignal      = "signal"
+	LogPhaseReload      = "reload"
+	LogPhaseRestart     = "restart"
+	LogPhaseStart       = "start"
+	LogPhaseCloseBefore = "close_before"
+	LogPhaseShutdown    = "shutdown"
+	LogPhaseCloseAfter  = "close_after"
+	LogPhaseFinalize    = "finalize"
+)
+
+// logAttrs builds the structured attributes of a log message. Empty values
+// get omitted.
+func logAttrs(phase, service, addr string, err error) []slog.Attr {
+	attrs := make([]slog.Attr, 0, 4)
+	if phase != "" {
+		attrs = append(attrs, slog.String(LogKeyPhase, phase))
+	}
+	if service != "" {
+		attrs = append(attrs, slog.String(LogKeyService, service))
+	}
+	if addr != "" {
+		attrs = append(attrs, slog.String(LogKeyAddr, addr))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any(LogKeyErr, err))
+	}
+	return attrs
+}
+
+// logInfo logs the printf style message via Options.LogInfo and, together
+// with the attributes, via Options.Logger.
+func logInfo(opt Options, attrs []slog.Attr, format string, args ...interface{}) {
+	opt.LogInfo(format, args...)
+	if opt.Logger != nil {
+		opt.Logger.LogAttrs(context.Background(), slog.LevelInfo, fmt.Sprintf(format, args...), attrs...)
+	}
+}
+
+// logError logs the printf style message via Options.LogError and, together
+// with the attributes, via Options.Logger.
+func logError(opt Options, attrs []slog.Attr, format string, args ...interface{}) {
+	opt.LogError(format, args...)
+	if opt.Logger != nil {
+		opt.Logger.LogAttrs(context.Background(), slog.LevelError, fmt.Sprintf(format, args...), attrs...)
+	}
+}
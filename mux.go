@@ -0,0 +1,307 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// muxMatchTimeout limits the time a connection has to send the bytes the
+// matchers of WithMuxListener inspect.
+const muxMatchTimeout = 10 * time.Second
+
+// MuxMatcher reports whether a connection belongs to a MuxRoute. It inspects
+// the first bytes of the connection with r.Peek and must not consume them.
+type MuxMatcher func(r *bufio.Reader) bool
+
+// MuxRoute dispatches the connections matched by Match to Server.
+type MuxRoute struct {
+	// Name identifies the route in errors.
+	Name   string
+	Match  MuxMatcher
+	Server Server
+}
+
+// WithMuxListener shares one TCP listener at the address between several
+// servers, for example gRPC and HTTP on the same port. Each accepted
+// connection gets dispatched to the first route whose matcher matches,
+// connections matching no route get closed. On shutdown the listener gets
+// closed and all servers get shut down concurrently.
+func WithMuxListener(addr string, routes ...MuxRoute) Config {
+	return func(s *services) error {
+		if len(routes) == 0 {
+			return fmt.Errorf("mux listener %s: no routes", addr)
+		}
+		for _, rt := range routes {
+			if rt.Match == nil || rt.Server == nil {
+				return fmt.Errorf("mux listener %s: route %q requires a matcher and a server", addr, rt.Name)
+			}
+		}
+		s.servers = append(s.servers, &server{name: addr, addr: addr, Server: newMuxServer(routes)})
+		return nil
+	}
+}
+
+// MatchAny matches every connection. Use it for the last route.
+func MatchAny(*bufio.Reader) bool { return true }
+
+// MatchTLS matches connections starting with a TLS handshake.
+func MatchTLS(r *bufio.Reader) bool {
+	b, err := r.Peek(2)
+	return err == nil && b[0] == 0x16 && b[1] == 0x03
+}
+
+// MatchHTTP1 matches connections starting with a HTTP/1 request line.
+func MatchHTTP1(r *bufio.Reader) bool {
+	for _, m := range []string{"GET ", "POST ", "PUT ", "DELETE ", "HEAD ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "} {
+		if peekPrefix(r, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHTTP2 matches connections starting with the HTTP/2 client preface
+// without TLS (h2c), which includes gRPC without TLS.
+func MatchHTTP2(r *bufio.Reader) bool {
+	return peekPrefix(r, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+}
+
+// peekPrefix reports whether r starts with prefix. It only waits for more
+// bytes as long as the bytes received so far match.
+func peekPrefix(r *bufio.Reader, prefix string) bool {
+	for n := 1; n <= len(prefix); n++ {
+		b, err := r.Peek(n)
+		if err != nil || b[n-1] != prefix[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// muxServer implements Server by dispatching the connections of one listener
+// to the servers of its routes.
+type muxServer struct {
+	routes    []MuxRoute
+	listeners []*muxListener
+	closing   atomic.Bool
+	wg        sync.WaitGroup // route servers serving
+
+	mu      sync.Mutex
+	lis     net.Listener
+	pending map[net.Conn]struct{} // connections being matched
+}
+
+func newMuxServer(routes []MuxRoute) *muxServer {
+	m := &muxServer{
+		routes:  routes,
+		pending: make(map[net.Conn]struct{}),
+	}
+	for range routes {
+		m.listeners = append(m.listeners, &muxListener{conns: make(chan net.Conn), done: make(chan struct{})})
+	}
+	return m
+}
+
+// SetLog passes the log functions to the route servers supporting them.
+func (m *muxServer) SetLog(info, err func(format string, args ...interface{})) {
+	for _, rt := range m.routes {
+		if ls, ok := rt.Server.(interface {
+			SetLog(info, err func(format string, args ...interface{}))
+		}); ok {
+			ls.SetLog(info, err)
+		}
+	}
+}
+
+func (m *muxServer) Serve(lis net.Listener) error {
+	m.mu.Lock()
+	if m.closing.Load() {
+		m.mu.Unlock()
+		_ = lis.Close()
+		return http.ErrServerClosed
+	}
+	m.lis = lis
+	m.wg.Add(len(m.routes))
+	m.mu.Unlock()
+
+	errc := make(chan error, len(m.routes))
+	for i, rt := range m.routes {
+		ml := m.listeners[i]
+		ml.addr = lis.Addr()
+		go func(rt MuxRoute) {
+			defer m.wg.Done()
+			if err := rt.Server.Serve(ml); err != nil && !errors.Is(err, http.ErrServerClosed) && !m.closing.Load() {
+				errc <- fmt.Errorf("mux route %q: %w", rt.Name, err)
+				_ = lis.Close()
+			}
+		}(rt)
+	}
+
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			select {
+			case rErr := <-errc:
+				return rErr
+			default:
+			}
+			if m.closing.Load() {
+				return http.ErrServerClosed
+			}
+			_ = lis.Close()
+			return err
+		}
+		go m.dispatch(c)
+	}
+}
+
+// dispatch passes c to the listener of the first matching route.
+func (m *muxServer) dispatch(c net.Conn) {
+	m.mu.Lock()
+	if m.closing.Load() {
+		m.mu.Unlock()
+		_ = c.Close()
+		return
+	}
+	m.pending[c] = struct{}{}
+	m.mu.Unlock()
+
+	_ = c.SetReadDeadline(time.Now().Add(muxMatchTimeout))
+	br := bufio.NewReader(c)
+	matched := -1
+	for i, rt := range m.routes {
+		if rt.Match(br) {
+			matched = i
+			break
+		}
+	}
+	_ = c.SetReadDeadline(time.Time{})
+
+	m.mu.Lock()
+	delete(m.pending, c)
+	m.mu.Unlock()
+	if matched < 0 || !m.listeners[matched].push(&muxConn{Conn: c, r: br}) {
+		_ = c.Close()
+	}
+}
+
+// stop stops accepting and closes the connections being matched.
+func (m *muxServer) stop() {
+	m.mu.Lock()
+	m.closing.Store(true)
+	if m.lis != nil {
+		_ = m.lis.Close()
+	}
+	for c := range m.pending {
+		_ = c.Close()
+	}
+	m.mu.Unlock()
+	for _, ml := range m.listeners {
+		_ = ml.Close()
+	}
+}
+
+func (m *muxServer) Shutdown(ctx context.Context) error {
+	m.stop()
+	errs := make([]error, len(m.routes))
+	var wg sync.WaitGroup
+	for i, rt := range m.routes {
+		wg.Add(1)
+		go func(i int, rt MuxRoute) {
+			defer wg.Done()
+			if err := rt.Server.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("mux route %q: %w", rt.Name, err)
+			}
+		}(i, rt)
+	}
+	wg.Wait()
+
+	served := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-ctx.Done():
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func (m *muxServer) Close() error {
+	m.stop()
+	var errs []error
+	for _, rt := range m.routes {
+		if err := rt.Server.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("mux route %q: %w", rt.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// muxListener passes the connections of a route to its server.
+type muxListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+// push hands c to Accept. It returns false once the listener has been
+// closed.
+func (l *muxListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr { return l.addr }
+
+// muxConn reads first the bytes buffered while matching.
+type muxConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *muxConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,99 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PacketServer defines a server which serves on a packet connection, for
+// example an HTTP/3 server on UDP, see sub package http3run.
+type PacketServer interface {
+	// Serve blocks until the server has been shut down or closed.
+	Serve(net.PacketConn) error
+	// Shutdown gracefully shuts down the server. It must return ctx.Err()
+	// when the context is done before all connections have finished.
+	Shutdown(ctx context.Context) error
+	// Close forcefully closes all connections.
+	Close() error
+}
+
+// WithPacketServer binds the UDP address before serving, like the listeners of
+// the other servers, so that Options.OnListen, Options.OnReady,
+// Options.BindRetry and Options.ListenConfig apply, and shutdowns the
+// PacketServer. The connection gets closed once Serve has returned.
+func WithPacketServer(addr string, srv PacketServer) Config {
+	return func(s *services) error {
+		s.servers = append(s.servers, &server{name: addr, addr: addr, Server: packetServer{srv}, network: networkUDP})
+		return nil
+	}
+}
+
+const networkUDP = "udp"
+
+// listenPacket binds the UDP address and wraps the connection into a
+// net.Listener for the listen loop of the Runner.
+func listenPacket(ctx context.Context, opt Options, addr string) (net.Listener, error) {
+	lc := opt.listenConfig()
+	pc, err := lc.ListenPacket(ctx, networkUDP, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &packetListener{PacketConn: pc, closed: make(chan struct{})}, nil
+}
+
+// packetListener carries a net.PacketConn through the listeners of the
+// Runner. Accept blocks until the listener has been closed.
+type packetListener struct {
+	net.PacketConn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (pl *packetListener) Accept() (net.Conn, error) {
+	<-pl.closed
+	return nil, net.ErrClosed
+}
+
+func (pl *packetListener) Close() error {
+	err := net.ErrClosed
+	pl.once.Do(func() {
+		close(pl.closed)
+		err = pl.PacketConn.Close()
+	})
+	return err
+}
+
+func (pl *packetListener) Addr() net.Addr {
+	return pl.LocalAddr()
+}
+
+// packetServer adapts a PacketServer to a Server.
+type packetServer struct {
+	PacketServer
+}
+
+func (ps packetServer) Serve(lis net.Listener) error {
+	pl, ok := lis.(*packetListener)
+	if !ok {
+		_ = lis.Close()
+		return fmt.Errorf("packet server cannot serve on listener %T", lis)
+	}
+	defer pl.Close()
+	return ps.PacketServer.Serve(pl.PacketConn)
+}
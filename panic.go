@@ -0,0 +1,60 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"strconv"
+)
+
+// PanicPolicy decides what happens when a start function panics, see
+// WithStartFuncRecover.
+type PanicPolicy int
+
+// The panic policies.
+const (
+	// FailAll shuts down all services and returns the panic as error. It is
+	// the default for all start functions.
+	FailAll PanicPolicy = iota
+	// Isolate logs the panic and abandons the start function while all other
+	// services continue to run.
+	Isolate
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case FailAll:
+		return "FailAll"
+	case Isolate:
+		return "Isolate"
+	}
+	return "PanicPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// WithStartFuncRecover starts the function in its own go routine like
+// WithStartFunc and handles a panic according to onPanic.
+func WithStartFuncRecover(name string, fn func() error, onPanic PanicPolicy) Config {
+	return func(s *services) error {
+		s.starts = append(s.starts, named{name: name, startFn: func(context.Context) error { return fn() }, onPanic: onPanic})
+		return nil
+	}
+}
+
+// isolatePanic reports whether err is a panic of a start function which must
+// not affect the other services.
+func isolatePanic(st named, err error) bool {
+	pe, ok := err.(*panicError)
+	return ok && st.onPanic == Isolate && pe.name == st.name
+}
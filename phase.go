@@ -0,0 +1,98 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import "strconv"
+
+// Phase identifies a phase of the shutdown, see Options.OnPhase.
+type Phase int
+
+// The phases of the shutdown. The step phases follow Options.ShutdownOrder,
+// the phases of steps running concurrently get reported in their listed
+// order.
+const (
+	// PhaseStart covers starting and running the services before the
+	// shutdown. It only identifies failures, see ServiceError, and does not
+	// get reported to Options.OnPhase.
+	PhaseStart Phase = iota + 1
+	// PhaseShutdownBegin begins the shutdown after a signal, Runner.Stop, a
+	// canceled Options.Context or a failing service.
+	PhaseShutdownBegin
+	// PhasePreShutdownDelay starts the delay, see Options.PreShutdownDelay.
+	// It gets skipped without a delay.
+	PhasePreShutdownDelay
+	// PhaseClosersBefore starts StepClosersBefore.
+	PhaseClosersBefore
+	// PhaseServers starts StepServers, the servers drain their connections.
+	PhaseServers
+	// PhaseStopFuncs starts StepStopFuncs.
+	PhaseStopFuncs
+	// PhaseClosersAfter starts StepClosersAfter.
+	PhaseClosersAfter
+	// PhaseClosersAfterConcurrent starts StepClosersAfterConcurrent.
+	PhaseClosersAfterConcurrent
+	// PhaseComplete ends the run once all services and finalizers have been
+	// stopped. It also gets reported when the start failed.
+	PhaseComplete
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseStart:
+		return "Start"
+	case PhaseShutdownBegin:
+		return "ShutdownBegin"
+	case PhasePreShutdownDelay:
+		return "PreShutdownDelay"
+	case PhaseClosersBefore:
+		return "ClosersBefore"
+	case PhaseServers:
+		return "Servers"
+	case PhaseStopFuncs:
+		return "StopFuncs"
+	case PhaseClosersAfter:
+		return "ClosersAfter"
+	case PhaseClosersAfterConcurrent:
+		return "ClosersAfterConcurrent"
+	case PhaseComplete:
+		return "Complete"
+	}
+	return "Phase(" + strconv.Itoa(int(p)) + ")"
+}
+
+// phase returns the Phase starting the step.
+func (s ShutdownStep) phase() Phase {
+	switch s {
+	case StepClosersBefore:
+		return PhaseClosersBefore
+	case StepServers:
+		return PhaseServers
+	case StepStopFuncs:
+		return PhaseStopFuncs
+	case StepClosersAfter:
+		return PhaseClosersAfter
+	case StepClosersAfterConcurrent:
+		return PhaseClosersAfterConcurrent
+	}
+	return 0
+}
+
+// phase reports p to Options.OnPhase.
+func (r *Runner) phase(p Phase) {
+	r.curPhase.Store(int32(p))
+	if r.opt.OnPhase != nil {
+		r.opt.OnPhase(p)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// WithStartFuncPriority starts the function in its own go routine once all
+// functions with a lower priority have called ready or returned. Functions
+// with the same priority start concurrently. Options.OnReady fires after all
+// functions have called ready or returned. During shutdown the contexts get
+// canceled in reverse priority order: a group gets canceled once all
+// functions of the next higher priority have returned or the
+// Options.ShutdownTimeout has elapsed. The context carries the values of
+// Options.Context.
+func WithStartFuncPriority(name string, priority int, fn func(ctx context.Context, ready func()) error) Config {
+	return func(s *services) error {
+		s.prioStarts = append(s.prioStarts, prioStart{name: name, priority: priority, fn: fn})
+		return nil
+	}
+}
+
+type prioStart struct {
+	name     string
+	priority int
+	fn       func(ctx context.Context, ready func()) error
+}
+
+// prioGroup contains all start functions with the same priority.
+type prioGroup struct {
+	priority int
+	starts   []prioStart
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// newPrioGroups groups the start functions by ascending priority. The group
+// contexts carry the values of parent but get canceled only by stop.
+func newPrioGroups(parent context.Context, starts []prioStart) []*prioGroup {
+	sorted := append([]prioStart(nil), starts...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].priority < sorted[j].priority })
+
+	var groups []*prioGroup
+	for _, ps := range sorted {
+		if len(groups) == 0 || groups[len(groups)-1].priority != ps.priority {
+			ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+			groups = append(groups, &prioGroup{priority: ps.priority, ctx: ctx, cancel: cancel})
+		}
+		g := groups[len(groups)-1]
+		g.starts = append(g.starts, ps)
+	}
+	return groups
+}
+
+// add registers a new running function. It returns false once the group has
+// been stopped.
+func (g *prioGroup) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+// stop cancels the context of the group and waits until all its functions
+// have returned or ctx is done.
+func (g *prioGroup) stop(ctx context.Context) error {
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+	g.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// launchPrioGroups launches the groups in ascending priority and waits for
+// each group to be ready before launching the next one.
+func launchPrioGroups(ctx context.Context, opt Options, g *errgroup.Group, rep *reporter, rdy *readiness, groups []*prioGroup) {
+	for _, pg := range groups {
+		var readyWG sync.WaitGroup
+		for _, ps := range pg.starts {
+			if !pg.add() {
+				return
+			}
+			ps := ps
+			var once sync.Once
+			ready := func() {
+				once.Do(func() {
+					rdy.done(ps.name)
+					readyWG.Done()
+				})
+			}
+			readyWG.Add(1)
+			g.Go(func() (err error) {
+				defer pg.wg.Done()
+				defer ready()
+				defer wrapError(ps.name, PhaseStart, &err)
+				defer recoverPanic(opt, ps.name, &err)
+				logInfo(opt, logAttrs(LogPhaseStart, ps.name, "", nil), "starting %q with priority %d", ps.name, ps.priority)
+				if err := ps.fn(pg.ctx, ready); !cleanExit(opt, err) {
+					rep.failed(ps.name, err)
+					return err
+				}
+				rep.stopped(ps.name)
+				return nil
+			})
+			rep.started(ps.name)
+		}
+
+		groupReady := make(chan struct{})
+		go func() {
+			readyWG.Wait()
+			close(groupReady)
+		}()
+		select {
+		case <-groupReady:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stopPrioGroups stops the groups in descending priority.
+func stopPrioGroups(parent context.Context, opt Options, rep *reporter, groups []*prioGroup) (errs []error) {
+	for i := len(groups) - 1; i >= 0; i-- {
+		pg := groups[i]
+		logInfo(opt, logAttrs(LogPhaseShutdown, "", "", nil), "stopping start functions with priority %d", pg.priority)
+		for _, ps := range pg.starts {
+			rep.stopping(ps.name)
+		}
+		ctx, cancel := shutdownContext(parent, opt)
+		err := pg.stop(ctx)
+		cancel()
+		if err != nil {
+			logError(opt, logAttrs(LogPhaseShutdown, "", "", err), "start functions with priority %d failed to stop with error: %s", pg.priority, err)
+			for _, ps := range pg.starts {
+				rep.failed(ps.name, err)
+			}
+			errs = append(errs, fmt.Errorf("priority %d: %w", pg.priority, err))
+		}
+	}
+	return errs
+}
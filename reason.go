@@ -0,0 +1,72 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+)
+
+// Reason describes why the shutdown began, see ShutdownReason.
+type Reason int32
+
+// The reasons of the shutdown.
+const (
+	// ReasonStop means Runner.Stop or Options.TriggerShutdown.
+	ReasonStop Reason = iota + 1
+	// ReasonSignal means a signal, see Options.Signals.
+	ReasonSignal
+	// ReasonContextCanceled means Options.Context got canceled.
+	ReasonContextCanceled
+	// ReasonServiceFailed means a service failed to start or while running.
+	ReasonServiceFailed
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonStop:
+		return "Stop"
+	case ReasonSignal:
+		return "Signal"
+	case ReasonContextCanceled:
+		return "ContextCanceled"
+	case ReasonServiceFailed:
+		return "ServiceFailed"
+	}
+	return "Reason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// shutdownReasonKey stores the shutdown reason of the Runner in the contexts
+// passed to the services.
+type shutdownReasonKey struct{}
+
+// ShutdownReason returns why the shutdown began. It reports false before the
+// shutdown begins. It works with the contexts of start and stop functions,
+// closers and the request contexts of the servers created by this package,
+// for example to flush instead of discarding buffered work on ReasonSignal.
+func ShutdownReason(ctx context.Context) (Reason, bool) {
+	if r, ok := ctx.Value(shutdownReasonKey{}).(*atomic.Int32); ok {
+		if reason := Reason(r.Load()); reason != 0 {
+			return reason, true
+		}
+	}
+	return 0, false
+}
+
+// setReason records the reason unless one has already been recorded.
+func (r *Runner) setReason(reason Reason) {
+	r.reason.CompareAndSwap(0, int32(reason))
+}
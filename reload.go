@@ -0,0 +1,114 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval defines how often the certificate files get checked for
+// modifications.
+const certCheckInterval = time.Second
+
+// WithReloadableTLS starts and shutdowns the handler as TLS server at the
+// address. The certificate gets reloaded from the files, without dropping
+// existing connections, when SIGHUP, which must be listed in Options.Signals,
+// has been received or when the modification time of the files changes.
+func WithReloadableTLS(addr, certFile, keyFile string, handler http.Handler) Config {
+	return func(s *services) error {
+		cr := &certReloader{certFile: certFile, keyFile: keyFile}
+		if err := cr.reload(); err != nil {
+			return err
+		}
+		srv := newOwnHTTPServer(&http.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: &tls.Config{GetCertificate: cr.getCertificate},
+		}, "", "")
+		srv.tlsFromConfig = true
+		s.servers = append(s.servers, srv)
+		s.reloaders = append(s.reloaders, named{name: addr, reloadFn: cr.reload})
+		return nil
+	}
+}
+
+// certReloader caches a certificate and reloads it from the files once they
+// change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// getCertificate returns the cached certificate and reloads it when the files
+// have been modified. A failing reload keeps the cached certificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	cert, modTime, check := cr.cert, cr.modTime, time.Since(cr.lastCheck) > certCheckInterval
+	cr.mu.RUnlock()
+	if !check {
+		return cert, nil
+	}
+
+	cr.mu.Lock()
+	cr.lastCheck = time.Now()
+	cr.mu.Unlock()
+	if mt, err := cr.filesModTime(); err == nil && !mt.Equal(modTime) {
+		if err := cr.reload(); err == nil {
+			cr.mu.RLock()
+			cert = cr.cert
+			cr.mu.RUnlock()
+		}
+	}
+	return cert, nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Report describes the outcome of each service run by GoResult.
+type Report struct {
+	// Services contains the servers, start functions and closers keyed by
+	// their name or address. Services sharing a name share an entry.
+	Services map[string]ServiceReport
+}
+
+// ServiceReport describes the outcome of a single service.
+type ServiceReport struct {
+	// Started reports whether the server was listening or the start function
+	// was launched. Always false for closers.
+	Started bool
+	// Stopped reports whether the server has been shut down, the start
+	// function has returned or the closer has been closed without an error.
+	Stopped bool
+	// Err contains all errors the service returned.
+	Err error
+	// ShutdownDuration contains the time the service took to stop.
+	ShutdownDuration time.Duration
+	// Connections contains the number of active connections when the server
+	// started to drain, see EventDraining.
+	Connections int
+}
+
+// EventType defines the kind of an Event.
+type EventType int
+
+// The event types passed to Options.OnEvent.
+const (
+	// EventStarted gets emitted once a server listens or a start function has
+	// been launched. The duration contains the time since Go has been called.
+	EventStarted EventType = iota + 1
+	// EventShutdownBegin gets emitted before a server gets shut down, a stop
+	// function or a closer gets called.
+	EventShutdownBegin
+	// EventShutdownComplete gets emitted once a server has been shut down, a
+	// start function has returned or a closer has been closed without error.
+	// The duration contains the time since EventShutdownBegin, if any.
+	EventShutdownComplete
+	// EventError gets emitted for each error a service returns.
+	EventError
+	// EventDraining gets emitted when a server starts to shut down and then
+	// every second as long as it has active connections. Connections
+	// contains their number.
+	EventDraining
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventStarted:
+		return "Started"
+	case EventShutdownBegin:
+		return "ShutdownBegin"
+	case EventShutdownComplete:
+		return "ShutdownComplete"
+	case EventError:
+		return "Error"
+	case EventDraining:
+		return "Draining"
+	}
+	return "EventType(" + strconv.Itoa(int(et)) + ")"
+}
+
+// Event describes a lifecycle change of a service, see Options.OnEvent.
+type Event struct {
+	Type EventType
+	// Name contains the name or address of the service.
+	Name     string
+	Time     time.Time
+	Duration time.Duration
+	// Err is set for EventError.
+	Err error
+	// Connections is set for EventDraining.
+	Connections int
+}
+
+// reporter records the lifecycle of the services for the Report and emits it
+// to Options.OnEvent.
+type reporter struct {
+	onEvent func(Event)
+	begin   time.Time
+
+	mu            sync.Mutex
+	services      map[string]ServiceReport
+	shutdownBegin map[string]time.Time
+}
+
+func newReporter(onEvent func(Event)) *reporter {
+	return &reporter{
+		onEvent:       onEvent,
+		begin:         time.Now(),
+		services:      make(map[string]ServiceReport),
+		shutdownBegin: make(map[string]time.Time),
+	}
+}
+
+func (r *reporter) emit(evt Event) {
+	if r.onEvent != nil {
+		r.onEvent(evt)
+	}
+}
+
+func (r *reporter) started(name string) {
+	r.mu.Lock()
+	sr := r.services[name]
+	sr.Started = true
+	r.services[name] = sr
+	r.mu.Unlock()
+
+	now := time.Now()
+	r.emit(Event{Type: EventStarted, Name: name, Time: now, Duration: now.Sub(r.begin)})
+}
+
+func (r *reporter) stopping(name string) {
+	now := time.Now()
+	r.mu.Lock()
+	r.shutdownBegin[name] = now
+	r.mu.Unlock()
+
+	r.emit(Event{Type: EventShutdownBegin, Name: name, Time: now})
+}
+
+func (r *reporter) stopped(name string) {
+	now := time.Now()
+	r.mu.Lock()
+	sr := r.services[name]
+	sr.Stopped = sr.Err == nil
+	var d time.Duration
+	if begin, ok := r.shutdownBegin[name]; ok {
+		d = now.Sub(begin)
+	}
+	sr.ShutdownDuration = d
+	r.services[name] = sr
+	r.mu.Unlock()
+
+	r.emit(Event{Type: EventShutdownComplete, Name: name, Time: now, Duration: d})
+}
+
+func (r *reporter) draining(name string, conns int) {
+	r.mu.Lock()
+	sr := r.services[name]
+	if sr.Connections == 0 {
+		sr.Connections = conns
+	}
+	r.services[name] = sr
+	r.mu.Unlock()
+
+	r.emit(Event{Type: EventDraining, Name: name, Time: time.Now(), Connections: conns})
+}
+
+func (r *reporter) failed(name string, err error) {
+	r.mu.Lock()
+	sr := r.services[name]
+	sr.Stopped = false
+	sr.Err = errors.Join(sr.Err, err)
+	r.services[name] = sr
+	r.mu.Unlock()
+
+	r.emit(Event{Type: EventError, Name: name, Time: time.Now(), Err: err})
+}
+
+func (r *reporter) report() Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := Report{Services: make(map[string]ServiceReport, len(r.services))}
+	for name, sr := range r.services {
+		rep.Services[name] = sr
+	}
+	return rep
+}
+
+// reportFile defines the JSON written to Options.ShutdownReportPath.
+type reportFile struct {
+	Error    string                       `json:"error,omitempty"`
+	Services map[string]serviceReportFile `json:"services"`
+}
+
+type serviceReportFile struct {
+	Started          bool   `json:"started"`
+	Stopped          bool   `json:"stopped"`
+	Error            string `json:"error,omitempty"`
+	ShutdownDuration string `json:"shutdown_duration,omitempty"`
+	Connections      int    `json:"connections,omitempty"`
+}
+
+// writeReport writes rep and the error of the run as JSON to path.
+func writeReport(path string, rep Report, runErr error) error {
+	rf := reportFile{Services: make(map[string]serviceReportFile, len(rep.Services))}
+	if runErr != nil {
+		rf.Error = runErr.Error()
+	}
+	for name, sr := range rep.Services {
+		srf := serviceReportFile{Started: sr.Started, Stopped: sr.Stopped, Connections: sr.Connections}
+		if sr.Err != nil {
+			srf.Error = sr.Err.Error()
+		}
+		if sr.ShutdownDuration > 0 {
+			srf.ShutdownDuration = sr.ShutdownDuration.String()
+		}
+		rf.Services[name] = srf
+	}
+	b, err := json.MarshalIndent(rf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// EnvInheritedListeners contains the comma separated addresses of the
+// listeners which a process, started by a graceful restart, inherits. The
+// first address belongs to file descriptor 3, the second to 4 and so on. A
+// server configured with one of the addresses serves on the inherited
+// listener instead of binding a new one.
+const EnvInheritedListeners = "RUNSERVICERUN_LISTENERS"
+
+// restarter hands the listeners of the servers over to a new process.
+type restarter struct {
+	mu        sync.Mutex
+	addrs     []string
+	listeners []net.Listener
+}
+
+func (r *restarter) add(addr string, lis net.Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs = append(r.addrs, addr)
+	r.listeners = append(r.listeners, lis)
+}
+
+// restart starts the current executable with the same arguments and passes
+// the listeners as inherited file descriptors.
+func (r *restarter) restart() (pid int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := make([]*os.File, 0, len(r.listeners)+3)
+	files = append(files, os.Stdin, os.Stdout, os.Stderr)
+	defer func() {
+		for _, f := range files[3:] {
+			_ = f.Close()
+		}
+	}()
+	for i, lis := range r.listeners {
+		if ocl, ok := lis.(*onceCloseListener); ok {
+			lis = ocl.Listener
+		}
+		fl, ok := lis.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %s of type %T cannot be inherited", r.addrs[i], lis)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, fmt.Errorf("listener %s: %w", r.addrs[i], err)
+		}
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, EnvInheritedListeners+"=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, EnvInheritedListeners+"="+strings.Join(r.addrs, ","))
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	if err != nil {
+		return 0, err
+	}
+	pid = p.Pid
+	return pid, p.Release()
+}
+
+// inheritListeners assigns the listeners passed by a graceful restart to the
+// servers with the same address. Listeners without a matching server get
+// closed.
+func inheritListeners(servers []*server) error {
+	env := os.Getenv(EnvInheritedListeners)
+	if env == "" {
+		return nil
+	}
+	_ = os.Unsetenv(EnvInheritedListeners)
+
+	for i, addr := range strings.Split(env, ",") {
+		fd := listenFDsStart + i
+		f := os.NewFile(uintptr(fd), "inherited "+addr)
+		lis, err := net.FileListener(f)
+		_ = f.Close() // FileListener duplicates the descriptor
+		if err != nil {
+			return fmt.Errorf("inherited listener %s fd %d: %w", addr, fd, err)
+		}
+		var used bool
+		for _, srv := range servers {
+			if !used && srv.lis == nil && srv.addr == addr && srv.network == "" {
+				srv.lis = &onceCloseListener{Listener: lis}
+				used = true
+			}
+		}
+		if !used {
+			_ = lis.Close()
+		}
+	}
+	return nil
+}
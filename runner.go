@@ -0,0 +1,525 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Runner starts and stops the configured servers/services without listening
+// for signals. Go uses a Runner and stops it on a signal. A Runner runs only
+// once.
+type Runner struct {
+	opt     Options
+	configs []Config
+	rep     *reporter
+
+	mu       sync.Mutex
+	started  bool
+	srvs     services
+	rs       restarter
+	stopOnce sync.Once
+	// shuttingDown gets set once the shutdown begins.
+	shuttingDown atomic.Bool
+	stopCh       chan struct{}
+	forceCtx     context.Context
+	force        context.CancelFunc
+	finished     chan struct{}
+	err          error
+	ready        <-chan struct{}
+	addrs        map[string]net.Addr
+	// curPhase holds the last reported Phase.
+	curPhase atomic.Int32
+	// budget limits the shutdown to Options.MaxShutdownDuration and closes
+	// exceeded once elapsed.
+	budget   *time.Timer
+	exceeded chan struct{}
+	// reason holds the Reason of the shutdown, see ShutdownReason.
+	reason atomic.Int32
+	// skippedClosers counts the closers skipped after exceeding the budget.
+	skippedClosers atomic.Int32
+}
+
+// NewRunner creates a Runner for the configs. Options.Signals gets ignored.
+func NewRunner(opt Options, configs ...Config) *Runner {
+	if opt.LogInfo == nil {
+		opt.LogInfo = func(string, ...interface{}) {}
+	}
+	if opt.LogError == nil {
+		opt.LogError = func(string, ...interface{}) {}
+	}
+	if opt.Context == nil {
+		opt.Context = context.Background()
+	}
+	if len(opt.ShutdownOrder) == 0 {
+		opt.ShutdownOrder = DefaultShutdownOrder()
+	}
+	r := &Runner{
+		opt:      opt,
+		configs:  configs,
+		rep:      newReporter(opt.OnEvent),
+		stopCh:   make(chan struct{}),
+		finished: make(chan struct{}),
+		addrs:    make(map[string]net.Addr),
+		exceeded: make(chan struct{}),
+	}
+	r.opt.Context = context.WithValue(opt.Context, shutdownReasonKey{}, &r.reason)
+	// the shutdown outlives opt.Context but keeps its values
+	r.forceCtx, r.force = context.WithCancel(context.WithoutCancel(r.opt.Context))
+	return r
+}
+
+// Start binds the listeners of all servers and launches the servers and start
+// functions in their own go routines. The ctx limits the binding of the
+// listeners. The services run until Stop gets called, Options.Context gets
+// canceled or one of them fails. When a listener cannot be bound, Start shuts
+// down everything, including the closers, and returns the error. Errors of
+// the configs, the options or the pre-start functions skip the closers. When
+// Options.Context has already been canceled, Start applies the configs, closes
+// the passed listeners, calls only the finalizers and returns its error.
+func (r *Runner) Start(ctx context.Context) error {
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return errors.New("runner already started")
+	}
+	r.started = true
+	r.mu.Unlock()
+
+	opt, rep := r.opt, r.rep
+	if err := validateShutdownOrder(opt.ShutdownOrder); err != nil {
+		r.finish(err)
+		return err
+	}
+	for _, srvFn := range r.configs {
+		if err := srvFn(&r.srvs); err != nil {
+			r.finish(err)
+			return err
+		}
+	}
+	if err := opt.Context.Err(); err != nil {
+		for _, srv := range r.srvs.servers {
+			if srv.lis != nil {
+				_ = srv.lis.Close()
+			}
+		}
+		r.finish(err)
+		return err
+	}
+	if err := validateDependencies(r.srvs.nodes); err != nil {
+		r.finish(err)
+		return err
+	}
+	if r.srvs.empty() && !opt.AllowNoServices {
+		r.finish(ErrNoServices)
+		return ErrNoServices
+	}
+	if !opt.AllowDuplicateAddresses {
+		if err := r.srvs.checkDuplicateAddresses(); err != nil {
+			r.finish(err)
+			return err
+		}
+	}
+	for _, ps := range r.srvs.preStarts {
+		logInfo(opt, logAttrs(LogPhaseStart, ps.name, "", nil), "pre-start %q", ps.name)
+		if err := callStart(ctx, opt, ps); err != nil {
+			logError(opt, logAttrs(LogPhaseStart, ps.name, "", err), "service %q failed to pre-start with error: %s", ps.name, err)
+			rep.failed(ps.name, err)
+			err = wrapService(ps.name, PhaseStart, err)
+			r.finish(err)
+			return err
+		}
+	}
+	if opt.EnableGracefulRestart {
+		if err := inheritListeners(r.srvs.servers); err != nil {
+			r.finish(err)
+			return err
+		}
+	}
+
+	prioGroups := newPrioGroups(opt.Context, r.srvs.prioStarts)
+
+	runCtx, cancelRun := context.WithCancel(opt.Context)
+	g, gctx := errgroup.WithContext(runCtx)
+
+	// goroutine to gracefully finish all functions once triggered. The errors
+	// of the shutdown get collected separately because the errgroup only
+	// keeps the first error, which is the failing service when the run fails.
+	var shutdownErrs []error
+	g.Go(func() error {
+		defer func() { shutdownErrs = r.shutdown(r.forceCtx, prioGroups) }()
+
+		select {
+		case <-r.stopCh:
+			r.setReason(ReasonStop)
+			r.shutdownBegins()
+			r.preShutdownDelay(gctx)
+			cancelRun()
+			return nil
+		case <-gctx.Done():
+			if opt.Context.Err() != nil {
+				r.setReason(ReasonContextCanceled)
+			} else {
+				r.setReason(ReasonServiceFailed)
+			}
+			r.shutdownBegins()
+			logInfo(opt, logAttrs(LogPhaseSignal, "", "", gctx.Err()), "context canceled, closing signal goroutine")
+			return gctx.Err()
+		}
+	})
+
+	rdy := newReadiness(r.srvs)
+	r.ready = rdy.ready
+	g.Go(func() error {
+		return rdy.wait(gctx, opt, r.srvs.onReady)
+	})
+
+	startCtx, cancelStart := context.WithCancel(gctx)
+	defer cancelStart()
+	if opt.StartTimeout > 0 {
+		startCtx, cancelStart = context.WithTimeout(gctx, opt.StartTimeout)
+		defer cancelStart()
+	}
+	defer context.AfterFunc(ctx, cancelStart)()
+
+	listeners := make([]net.Listener, len(r.srvs.servers))
+	// abort closes the bound listeners, shuts down and fails the run with err
+	abort := func(err error) error {
+		for _, lis := range listeners {
+			if lis != nil {
+				_ = lis.Close()
+			}
+		}
+		for _, srv := range r.srvs.servers {
+			if srv.lis != nil {
+				_ = srv.lis.Close()
+			}
+		}
+		g.Go(func() error { return err })
+		err = joinErrors(g.Wait(), shutdownErrs)
+		cancelRun()
+		r.finish(err)
+		return err
+	}
+	for i, srv := range r.srvs.servers {
+		lis, err := srv.listenRetry(startCtx, opt)
+		if err != nil && opt.ContinueOnListenError {
+			logError(opt, logAttrs(LogPhaseStart, srv.name, srv.addr, err), "server %s failed to listen with error: %s", srv.name, err)
+			srv.listenFailed.Store(true)
+			rep.failed(srv.name, err)
+			rdy.done(srv.name)
+			continue
+		}
+		if err != nil {
+			logError(opt, logAttrs(LogPhaseStart, srv.name, srv.addr, err), "server %s failed to listen with error: %s", srv.name, err)
+			rep.failed(srv.name, err)
+			return abort(wrapService(srv.name, PhaseStart, err))
+		}
+		if opt.OnListen != nil {
+			opt.OnListen(srv.name, lis.Addr())
+		}
+		if srv.addr != "" && srv.network == "" {
+			r.rs.add(srv.addr, lis)
+		}
+		listeners[i] = lis
+		r.mu.Lock()
+		r.addrs[srv.name] = lis.Addr()
+		r.mu.Unlock()
+		rep.started(srv.name)
+	}
+	if opt.AfterListen != nil {
+		if err := opt.AfterListen(); err != nil {
+			logError(opt, logAttrs(LogPhaseStart, "", "", err), "after listen failed with error: %s", err)
+			return abort(fmt.Errorf("after listen: %w", err))
+		}
+	}
+	for i, srv := range r.srvs.servers {
+		if listeners[i] != nil {
+			rdy.done(srv.name)
+		}
+	}
+
+	baseCtx := context.WithValue(gctx, shuttingDownKey{}, &r.shuttingDown)
+	for i, srv := range r.srvs.servers {
+		srv, lis := srv, listeners[i]
+		if lis == nil {
+			continue
+		}
+		if srv.ownHS {
+			if srv.hs.BaseContext == nil {
+				srv.hs.BaseContext = func(net.Listener) context.Context { return baseCtx }
+			}
+			srv.hs.Handler = closeOnShutdown(&r.shuttingDown, srv.hs.Handler)
+		}
+		if srv.hs != nil && srv.hs.ConnState == nil {
+			srv.hs.ConnState = srv.trackConn
+			srv.trackConns = true
+		}
+		g.Go(func() (err error) {
+			defer wrapError(srv.name, PhaseStart, &err)
+			defer recoverPanic(opt, srv.name, &err)
+			if err := srv.serve(opt, lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				rep.failed(srv.name, err)
+				return err
+			}
+			return nil
+		})
+	}
+
+	for _, srv := range r.srvs.starts {
+		srv := srv
+		var once sync.Once
+		ready := func() { once.Do(func() { rdy.done(srv.name) }) }
+		startFn := srv.startFn
+		if srv.startReadyFn != nil {
+			startFn = func(context.Context) error { return srv.startReadyFn(ready) }
+		}
+		if srv.supervise != nil {
+			startFn = srv.supervise.wrap(opt, srv.name, startFn)
+		}
+		if srv.onPanic == Isolate {
+			fn := startFn
+			startFn = func(ctx context.Context) (err error) {
+				defer recoverPanic(opt, srv.name, &err)
+				return fn(ctx)
+			}
+		}
+		g.Go(func() (err error) {
+			defer wrapError(srv.name, PhaseStart, &err)
+			defer recoverPanic(opt, srv.name, &err)
+			logInfo(opt, logAttrs(LogPhaseStart, srv.name, "", nil), "starting %q", srv.name)
+			if err := startFn(gctx); !cleanExit(opt, err) {
+				rep.failed(srv.name, err)
+				if isolatePanic(srv, err) {
+					logError(opt, logAttrs(LogPhaseStart, srv.name, "", err), "abandoned %q after its panic", srv.name)
+					return nil
+				}
+				return err
+			}
+			ready()
+			if srv.ticker {
+				logInfo(opt, logAttrs(LogPhaseShutdown, srv.name, "", nil), "ticker %q stopped", srv.name)
+			}
+			rep.stopped(srv.name)
+			return nil
+		})
+		rep.started(srv.name)
+		if srv.startReadyFn == nil {
+			ready()
+		}
+	}
+
+	if len(prioGroups) > 0 {
+		g.Go(func() error {
+			launchPrioGroups(gctx, opt, g, rep, rdy, prioGroups)
+			return nil
+		})
+	}
+
+	go func() {
+		err := joinErrors(g.Wait(), shutdownErrs)
+		cancelRun()
+		r.finish(err)
+	}()
+	return nil
+}
+
+// StartAndWait works like Start and additionally waits until all services are
+// ready, see Options.OnReady. It returns the addresses of the listeners keyed
+// by the server names, for example to dial servers listening on port 0 in
+// tests.
+func (r *Runner) StartAndWait(ctx context.Context) (map[string]net.Addr, error) {
+	if err := r.Start(ctx); err != nil {
+		return nil, err
+	}
+	select {
+	case <-r.ready:
+	case <-r.finished:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, errors.New("runner stopped before being ready")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return r.Addrs(), nil
+}
+
+// Addrs returns the addresses of the bound listeners keyed by the server
+// names. Servers sharing a name share an entry.
+func (r *Runner) Addrs() map[string]net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := make(map[string]net.Addr, len(r.addrs))
+	for name, addr := range r.addrs {
+		addrs[name] = addr
+	}
+	return addrs
+}
+
+// finish runs the finalizers and records the result of the run.
+func (r *Runner) finish(err error) {
+	if errs := closeAll(context.Background(), r.opt, r.rep, PhaseComplete, LogPhaseFinalize, "finalizing", r.srvs.finalizers); len(errs) > 0 {
+		err = errors.Join(append([]error{err}, errs...)...)
+	}
+	r.mu.Lock()
+	if r.budget != nil {
+		r.budget.Stop()
+	}
+	r.mu.Unlock()
+	r.err = err
+	r.phase(PhaseComplete)
+	r.force()
+	close(r.finished)
+}
+
+// Stop begins the graceful shutdown and waits until all services have been
+// stopped. It returns the error of the run. When ctx is done before, the
+// shutdown gets forced: servers get closed and the contexts of the stop
+// functions and closers get canceled. Stop can be called multiple times.
+func (r *Runner) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+	if !started {
+		return nil
+	}
+	r.trigger()
+	select {
+	case <-r.finished:
+	case <-ctx.Done():
+		r.force()
+		<-r.finished
+	}
+	return r.err
+}
+
+// trigger begins the graceful shutdown. It can be called multiple times.
+func (r *Runner) trigger() {
+	r.stopOnce.Do(func() { close(r.stopCh) })
+}
+
+// shutdownBegins calls the functions registered for the beginning of the
+// shutdown.
+func (r *Runner) shutdownBegins() {
+	r.shuttingDown.Store(true)
+	if d := r.opt.MaxShutdownDuration; d > 0 {
+		r.mu.Lock()
+		r.budget = time.AfterFunc(d, r.exceedBudget)
+		r.mu.Unlock()
+	}
+	r.phase(PhaseShutdownBegin)
+	for _, fn := range r.srvs.onShutdown {
+		fn()
+	}
+}
+
+// exceedBudget aborts the shutdown once Options.MaxShutdownDuration has
+// elapsed.
+func (r *Runner) exceedBudget() {
+	p := Phase(r.curPhase.Load())
+	logError(r.opt, logAttrs(LogPhaseShutdown, "", "", ErrMaxShutdownDuration), "shutdown exceeded %s in phase %s, aborting", r.opt.MaxShutdownDuration, p)
+	close(r.exceeded)
+	r.force()
+}
+
+// budgetExceeded reports whether Options.MaxShutdownDuration has elapsed.
+func (r *Runner) budgetExceeded() bool {
+	select {
+	case <-r.exceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// preShutdownDelay waits Options.PreShutdownDelay plus a random part of
+// Options.ShutdownJitter while all services keep running. A failing service or
+// a forced shutdown ends the delay early.
+func (r *Runner) preShutdownDelay(ctx context.Context) {
+	delay := r.opt.PreShutdownDelay
+	if r.opt.ShutdownJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(r.opt.ShutdownJitter)))
+		logInfo(r.opt, logAttrs(LogPhaseShutdown, "", "", nil), "shutdown jitter of %s", jitter)
+		delay += jitter
+	}
+	if delay <= 0 {
+		return
+	}
+	r.phase(PhasePreShutdownDelay)
+	logInfo(r.opt, logAttrs(LogPhaseShutdown, "", "", nil), "pre-shutdown delay of %s started", delay)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	case <-r.forceCtx.Done():
+	}
+	logInfo(r.opt, logAttrs(LogPhaseShutdown, "", "", nil), "pre-shutdown delay ended")
+}
+
+// Done returns a channel which gets closed once all services have been
+// stopped.
+func (r *Runner) Done() <-chan struct{} {
+	return r.finished
+}
+
+// Wait blocks until all services have been stopped and returns the error of
+// the run.
+func (r *Runner) Wait() error {
+	<-r.finished
+	return r.err
+}
+
+// Report describes which services have been started and stopped.
+func (r *Runner) Report() Report {
+	return r.rep.report()
+}
+
+// result returns the Report and err and writes them to
+// Options.ShutdownReportPath.
+func (r *Runner) result(err error) (Report, error) {
+	rep := r.Report()
+	if r.opt.ShutdownReportPath != "" {
+		if wErr := writeReport(r.opt.ShutdownReportPath, rep, err); wErr != nil {
+			logError(r.opt, logAttrs(LogPhaseShutdown, "", "", wErr), "failed to write the shutdown report with error: %s", wErr)
+		}
+	}
+	return rep, err
+}
+
+// reload reloads all reloadable servers and calls Options.OnReload.
+func (r *Runner) reload() {
+	for _, rl := range r.srvs.reloaders {
+		if err := rl.reloadFn(); err != nil {
+			logError(r.opt, logAttrs(LogPhaseReload, rl.name, "", err), "service %q failed to reload with error: %s", rl.name, err)
+		}
+	}
+	if r.opt.OnReload != nil {
+		if err := r.opt.OnReload(); err != nil {
+			logError(r.opt, logAttrs(LogPhaseReload, "", "", err), "reload failed with error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"sync"
+)
+
+// WithShutdownSequence registers the servers and closers of the configs in one
+// ordered list as an alternative to the phased closers before, servers and
+// closers after. The list shuts down in reverse order of the configs, one
+// entry after the other, during StepServers and concurrently to the other
+// servers. For example to stop the public server, then flush a buffer, then
+// stop the internal server and finally close the database:
+//
+//	WithShutdownSequence(
+//		WithCloserAfter("db", db),
+//		WithHTTPHandler(":8081", internal),
+//		WithCloserAfter("buffer", buf),
+//		WithHTTPHandler(":8080", public),
+//	)
+//
+// When a config registers servers and closers, its servers shut down first.
+// Everything else registered by the configs, like start functions, behaves as
+// without the sequence.
+func WithShutdownSequence(configs ...Config) Config {
+	return func(s *services) error {
+		for _, c := range configs {
+			entry, err := applyOrdered(s, c)
+			if err != nil {
+				return err
+			}
+			s.sequence = append(s.sequence, entry)
+		}
+		return nil
+	}
+}
+
+// applyOrdered applies c to s and returns the servers and closers of c, which
+// then shut down outside of the phases, see WithShutdownSequence and
+// WithDependsOn.
+func applyOrdered(s *services, c Config) (sequenceEntry, error) {
+	var sub services
+	if err := c(&sub); err != nil {
+		return sequenceEntry{}, err
+	}
+	var entry sequenceEntry
+	for _, srv := range sub.servers {
+		// servers of a nested sequence or node already shut down with it
+		if !srv.ordered {
+			srv.ordered = true
+			entry.servers = append(entry.servers, srv)
+		}
+	}
+	for _, closers := range [][]named{sub.closersBefore, sub.closersDuring, sub.closersAfter, sub.closersAfterConcurrent} {
+		entry.closers = append(entry.closers, closers...)
+	}
+	s.servers = append(s.servers, sub.servers...)
+	s.preStarts = append(s.preStarts, sub.preStarts...)
+	s.starts = append(s.starts, sub.starts...)
+	s.prioStarts = append(s.prioStarts, sub.prioStarts...)
+	s.reloaders = append(s.reloaders, sub.reloaders...)
+	s.finalizers = append(s.finalizers, sub.finalizers...)
+	s.onReady = append(s.onReady, sub.onReady...)
+	s.onShutdown = append(s.onShutdown, sub.onShutdown...)
+	s.sequence = append(s.sequence, sub.sequence...)
+	s.nodes = append(s.nodes, sub.nodes...)
+	return entry, nil
+}
+
+// sequenceEntry contains the servers and closers registered by one config of
+// WithShutdownSequence.
+type sequenceEntry struct {
+	servers []*server
+	closers []named
+}
+
+// shutdownSequence shuts down the entries of WithShutdownSequence in reverse
+// order.
+func shutdownSequence(ctx context.Context, opt Options, rep *reporter, sequence []sequenceEntry) (errs []error) {
+	for i := len(sequence) - 1; i >= 0; i-- {
+		errs = append(errs, shutdownServers(ctx, opt, rep, sequence[i].servers)...)
+		errs = append(errs, closeAll(ctx, opt, rep, PhaseServers, LogPhaseShutdown, "closing in sequence", sequence[i].closers)...)
+	}
+	return errs
+}
+
+// shutdownServersStep shuts down the servers not part of WithShutdownSequence
+// or WithDependsOn and, concurrently, the sequence, the dependency graph and
+// the closers of WithCloserDuring.
+func (r *Runner) shutdownServersStep(ctx context.Context) []error {
+	var servers []*server
+	for _, srv := range r.srvs.servers {
+		if !srv.ordered {
+			servers = append(servers, srv)
+		}
+	}
+	var seqErrs, nodeErrs, duringErrs []error
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		seqErrs = shutdownSequence(ctx, r.opt, r.rep, r.srvs.sequence)
+	}()
+	go func() {
+		defer wg.Done()
+		nodeErrs = shutdownNodes(ctx, r.opt, r.rep, r.srvs.nodes)
+	}()
+	go func() {
+		defer wg.Done()
+		duringErrs = closeConcurrent(ctx, r.opt, r.rep, PhaseServers, LogPhaseShutdown, "closing during drain", r.srvs.closersDuring)
+	}()
+	errs := shutdownServers(ctx, r.opt, r.rep, servers)
+	wg.Wait()
+	errs = append(errs, seqErrs...)
+	errs = append(errs, nodeErrs...)
+	return append(errs, duringErrs...)
+}
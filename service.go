@@ -19,64 +19,214 @@ package runservicerun
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+)
 
-	"golang.org/x/sync/errgroup"
+// Default timeouts of the http.Server created by WithHTTPHandler,
+// WithHTTPHandlerOpts and WithHTTPHandlerTLS. The request contexts of all
+// http.Server created by this package derive from Options.Context and get
+// canceled once the shutdown begins. The defaults protect against clients
+// keeping connections open by sending requests slowly (Slowloris).
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 120 * time.Second
 )
 
-// WithHTTPHandler starts and shutdowns the handler at the address.
+// newHandlerServer creates a http.Server with the default timeouts.
+func newHandlerServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+	}
+}
+
+// WithHTTPHandler starts and shutdowns the handler at the address. The server
+// uses DefaultReadHeaderTimeout and DefaultIdleTimeout.
+//
+// The request contexts get canceled when the shutdown begins, after
+// Options.PreShutdownDelay. Handlers of long-lived connections, like
+// WebSockets, must end on r.Context().Done() because http.Server.Shutdown
+// neither closes nor waits for hijacked connections.
 func WithHTTPHandler(addr string, handler http.Handler) Config {
+	return WithHTTPHandlerOpts(addr, handler)
+}
+
+// WithHTTPHandlerFunc same as WithHTTPHandler but takes a function.
+func WithHTTPHandlerFunc(addr string, fn func(http.ResponseWriter, *http.Request)) Config {
+	return WithHTTPHandler(addr, http.HandlerFunc(fn))
+}
+
+// WithHTTPHandlerOpts starts and shutdowns the handler at the address like
+// WithHTTPHandler. The opts modify the http.Server before it starts, for
+// example to override its default timeouts.
+func WithHTTPHandlerOpts(addr string, handler http.Handler, opts ...func(*http.Server)) Config {
 	return func(s *services) error {
-		s.httpServer = append(s.httpServer, &httpServer{
-			Server: &http.Server{
-				Addr:    addr,
-				Handler: handler,
-			},
-		})
+		hs := newHandlerServer(addr, handler)
+		for _, o := range opts {
+			o(hs)
+		}
+		s.servers = append(s.servers, newOwnHTTPServer(hs, "", ""))
 		return nil
 	}
 }
 
-// WithHTTPServer starts and shutdowns the given http.Server.
+// WithHTTPHandlerMiddleware starts and shutdowns the handler wrapped with the
+// middleware at the address like WithHTTPHandler. The first listed middleware
+// is the outermost one and sees the request first, so the same handler can be
+// served on several addresses with different middleware, for example
+// authentication only on the public address.
+func WithHTTPHandlerMiddleware(addr string, handler http.Handler, mw ...func(http.Handler) http.Handler) Config {
+	return func(s *services) error {
+		h := handler
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		return WithHTTPHandler(addr, h)(s)
+	}
+}
+
+// WithHTTPHandlerTimeout works like WithHTTPHandler and limits the shutdown of
+// this server to shutdownTimeout, which takes precedence over
+// Options.ShutdownTimeout. Zero uses Options.ShutdownTimeout.
+func WithHTTPHandlerTimeout(addr string, handler http.Handler, shutdownTimeout time.Duration) Config {
+	return func(s *services) error {
+		srv := newOwnHTTPServer(newHandlerServer(addr, handler), "", "")
+		srv.shutdownTimeout = shutdownTimeout
+		s.servers = append(s.servers, srv)
+		return nil
+	}
+}
+
+// WithHTTPHandlerReusePort starts and shutdowns the handler at the address
+// like WithHTTPHandler. The listener gets created with SO_REUSEPORT, so that
+// several processes can serve on the same port and the kernel balances the
+// connections between them. The shutdown closes only the listener of this
+// process. Only supported on Linux and BSD systems.
+func WithHTTPHandlerReusePort(addr string, handler http.Handler) Config {
+	return func(s *services) error {
+		if !reusePortSupported {
+			return fmt.Errorf("server %s: SO_REUSEPORT is not supported on %s", addr, runtime.GOOS)
+		}
+		srv := newOwnHTTPServer(newHandlerServer(addr, handler), "", "")
+		srv.reusePort = true
+		s.servers = append(s.servers, srv)
+		return nil
+	}
+}
+
+// WithHTTPServer starts and shutdowns the given http.Server. Its timeouts
+// and BaseContext stay untouched, set BaseContext to provide request contexts
+// with values. To end long-lived connections on shutdown, see WithHTTPHandler,
+// the BaseContext can be canceled via Options.OnPhase.
 func WithHTTPServer(hs *http.Server) Config {
 	return func(s *services) error {
-		s.httpServer = append(s.httpServer, &httpServer{
-			Server: hs,
-		})
+		s.servers = append(s.servers, newHTTPServer(hs, "", ""))
+		return nil
+	}
+}
+
+// WithHTTPServers works like WithHTTPServer for each of the servers.
+func WithHTTPServers(servers ...*http.Server) Config {
+	return func(s *services) error {
+		for _, hs := range servers {
+			s.servers = append(s.servers, newHTTPServer(hs, "", ""))
+		}
 		return nil
 	}
 }
 
 // WithHTTPHandlerTLS starts and shutdowns the handler as TLS server at the
-// address.
+// address. The server uses DefaultReadHeaderTimeout and DefaultIdleTimeout.
 func WithHTTPHandlerTLS(addr, certFile, keyFile string, tlsConfig *tls.Config, handler http.Handler) Config {
 	return func(s *services) error {
-		s.httpServer = append(s.httpServer, &httpServer{
-			Server: &http.Server{
-				TLSConfig: tlsConfig,
-				Addr:      addr,
-				Handler:   handler,
-			},
-			CertFile: certFile,
-			KeyFile:  keyFile,
-		})
+		hs := newHandlerServer(addr, handler)
+		hs.TLSConfig = tlsConfig
+		s.servers = append(s.servers, newOwnHTTPServer(hs, certFile, keyFile))
 		return nil
 	}
 }
 
-// WithHTTPServerTLS starts and shutdowns the http.Server as TLS server. Make
-// sure that http.Server.TLSConfig is set.
+// WithHTTPHandlerTLSConfig starts and shutdowns the handler as TLS server at
+// the address using only the certificates of tlsConfig, for example a
+// GetCertificate callback serving several domains via SNI. The tlsConfig must
+// contain Certificates, GetCertificate or GetConfigForClient. The server uses
+// DefaultReadHeaderTimeout and DefaultIdleTimeout.
+func WithHTTPHandlerTLSConfig(addr string, tlsConfig *tls.Config, handler http.Handler) Config {
+	return func(s *services) error {
+		hs := newHandlerServer(addr, handler)
+		hs.TLSConfig = tlsConfig
+		srv, err := newHTTPServerTLS(hs, "", "")
+		if err != nil {
+			return err
+		}
+		srv.ownHS = true
+		s.servers = append(s.servers, srv)
+		return nil
+	}
+}
+
+// WithHTTPHandlerFuncTLS same as WithHTTPHandlerTLS but takes a function.
+func WithHTTPHandlerFuncTLS(addr, certFile, keyFile string, tlsConfig *tls.Config, fn func(http.ResponseWriter, *http.Request)) Config {
+	return WithHTTPHandlerTLS(addr, certFile, keyFile, tlsConfig, http.HandlerFunc(fn))
+}
+
+// WithHTTPServerTLS starts and shutdowns the http.Server as TLS server. It
+// requires either the certificate and key file or a http.Server.TLSConfig
+// providing the certificates, otherwise it returns an error.
 func WithHTTPServerTLS(certFile, keyFile string, hs *http.Server) Config {
+	return WithHTTPServersTLS(certFile, keyFile, hs)
+}
+
+// WithHTTPServersTLS works like WithHTTPServerTLS for each of the servers,
+// which all use the same certificate.
+func WithHTTPServersTLS(certFile, keyFile string, servers ...*http.Server) Config {
 	return func(s *services) error {
-		s.httpServer = append(s.httpServer, &httpServer{
-			Server:   hs,
-			CertFile: certFile,
-			KeyFile:  keyFile,
-		})
+		for _, hs := range servers {
+			srv, err := newHTTPServerTLS(hs, certFile, keyFile)
+			if err != nil {
+				return err
+			}
+			s.servers = append(s.servers, srv)
+		}
+		return nil
+	}
+}
+
+// WithHTTPListener serves the handler on the already bound listener and
+// shutdowns it. The name gets used in the logs. The listener gets closed
+// during shutdown.
+func WithHTTPListener(name string, lis net.Listener, handler http.Handler) Config {
+	return func(s *services) error {
+		srv := newOwnHTTPServer(&http.Server{Handler: handler}, "", "")
+		srv.name = name
+		srv.lis = &onceCloseListener{Listener: lis}
+		s.servers = append(s.servers, srv)
+		return nil
+	}
+}
+
+// WithServer starts the Server on a TCP listener at the address and shutdowns
+// it. It allows to run servers other than http.Server, for example a gRPC
+// server, see sub package grpcrun.
+func WithServer(addr string, srv Server) Config {
+	return func(s *services) error {
+		s.servers = append(s.servers, &server{name: addr, addr: addr, Server: srv})
 		return nil
 	}
 }
@@ -84,7 +234,16 @@ func WithHTTPServerTLS(certFile, keyFile string, hs *http.Server) Config {
 // WithCloserBefore calls the Closer before shutting down the servers.
 func WithCloserBefore(name string, c io.Closer) Config {
 	return func(s *services) error {
-		s.closersBefore = append(s.closersBefore, named{name: name, Closer: c})
+		s.closersBefore = append(s.closersBefore, named{name: name, closeFn: closerFunc(c)})
+		return nil
+	}
+}
+
+// WithCloserBeforeContext calls the function before shutting down the
+// servers. The context is bound by Options.ShutdownTimeout.
+func WithCloserBeforeContext(name string, fn func(context.Context) error) Config {
+	return func(s *services) error {
+		s.closersBefore = append(s.closersBefore, named{name: name, closeFn: fn})
 		return nil
 	}
 }
@@ -92,150 +251,1329 @@ func WithCloserBefore(name string, c io.Closer) Config {
 // WithCloserAfter calls the Closer after shutting down the servers.
 func WithCloserAfter(name string, c io.Closer) Config {
 	return func(s *services) error {
-		s.closersAfter = append(s.closersAfter, named{name: name, Closer: c})
+		s.closersAfter = append(s.closersAfter, named{name: name, closeFn: closerFunc(c)})
+		return nil
+	}
+}
+
+// WithCloserAfterContext calls the function after shutting down the servers.
+// The context is bound by Options.ShutdownTimeout.
+func WithCloserAfterContext(name string, fn func(context.Context) error) Config {
+	return func(s *services) error {
+		s.closersAfter = append(s.closersAfter, named{name: name, closeFn: fn})
 		return nil
 	}
 }
 
+// WithCloserDuring calls the Closer while the servers drain, for example to
+// deregister from a service discovery without delaying the drain. The closers
+// registered via this function start together with StepServers and run
+// concurrently to the servers and to each other. StepServers, and so the
+// closers after, only finish once all of them have returned.
+func WithCloserDuring(name string, c io.Closer) Config {
+	return func(s *services) error {
+		s.closersDuring = append(s.closersDuring, named{name: name, closeFn: closerFunc(c)})
+		return nil
+	}
+}
+
+// WithCloserAfterConcurrent calls the Closer after shutting down the servers
+// and after all closers registered via WithCloserAfter. All closers
+// registered via this function run concurrently.
+func WithCloserAfterConcurrent(name string, c io.Closer) Config {
+	return func(s *services) error {
+		s.closersAfterConcurrent = append(s.closersAfterConcurrent, named{name: name, closeFn: closerFunc(c)})
+		return nil
+	}
+}
+
+// WithFinalizer calls fn exactly once after all services have been stopped,
+// however the run ends: by a signal, a failing service, a canceled
+// Options.Context or a failing start. Finalizers run in registration order
+// after all closers. A failing or panicking finalizer does not skip the
+// remaining ones.
+func WithFinalizer(name string, fn func() error) Config {
+	return func(s *services) error {
+		s.finalizers = append(s.finalizers, named{name: name, closeFn: func(context.Context) error { return fn() }})
+		return nil
+	}
+}
+
+func closerFunc(c io.Closer) func(context.Context) error {
+	return func(context.Context) error { return c.Close() }
+}
+
 // WithStartFunc starts the function in its own go routine.
 func WithStartFunc(name string, fn func() error) Config {
+	return func(s *services) error {
+		s.starts = append(s.starts, named{name: name, startFn: func(context.Context) error { return fn() }})
+		return nil
+	}
+}
+
+// WithStartFuncContext starts the function in its own go routine. The context
+// gets canceled when the shutdown begins.
+func WithStartFuncContext(name string, fn func(context.Context) error) Config {
 	return func(s *services) error {
 		s.starts = append(s.starts, named{name: name, startFn: fn})
 		return nil
 	}
 }
 
-type httpServer struct {
-	CertFile, KeyFile string
-	*http.Server
+// WithStartFuncReady starts the function in its own go routine. The function
+// must call ready once it has been fully initialized. Options.OnReady fires
+// after all such functions have called ready or returned without an error.
+func WithStartFuncReady(name string, fn func(ready func()) error) Config {
+	return func(s *services) error {
+		s.starts = append(s.starts, named{name: name, startReadyFn: fn})
+		return nil
+	}
+}
+
+// WithPreStart calls the function, for example a validation or migration,
+// before any listener gets bound. All pre-start functions run sequentially in
+// registration order. When one fails, Go returns its error without starting
+// any service or calling any closer.
+func WithPreStart(name string, fn func(context.Context) error) Config {
+	return func(s *services) error {
+		s.preStarts = append(s.preStarts, named{name: name, startFn: fn})
+		return nil
+	}
+}
+
+// Service runs until stopped, for example a message queue consumer. Start
+// blocks while the service runs. Stop stops consuming, drains the in-flight
+// work, closes the connections and must cause Start to return.
+type Service interface {
+	Start(context.Context) error
+	Stop(context.Context) error
+}
+
+// WithService starts svc in its own go routine and stops it during shutdown,
+// alongside the servers, see StepStopFuncs. Unlike WithStartFuncContext, the
+// context passed to Start keeps running while Stop drains and gets canceled
+// once Stop has returned. Start returning the error of that context counts as
+// a clean exit.
+func WithService(name string, svc Service) Config {
+	return func(s *services) error {
+		stopped, markStopped := context.WithCancel(context.Background())
+		s.starts = append(s.starts, named{
+			name: name,
+			startFn: func(ctx context.Context) error {
+				ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+				defer cancel()
+				defer context.AfterFunc(stopped, cancel)()
+				if err := svc.Start(ctx); err != nil && (ctx.Err() == nil || !errors.Is(err, ctx.Err())) {
+					return err
+				}
+				return nil
+			},
+			stopFn: func(ctx context.Context) error {
+				defer markStopped()
+				return svc.Stop(ctx)
+			},
+		})
+		return nil
+	}
+}
+
+// WithStartStopFunc starts the function start in its own go routine. The
+// function stop gets called during shutdown, alongside the servers, and must
+// cause start to return.
+func WithStartStopFunc(name string, start func() error, stop func(context.Context) error) Config {
+	return func(s *services) error {
+		s.starts = append(s.starts, named{
+			name:    name,
+			startFn: func(context.Context) error { return start() },
+			stopFn:  stop,
+		})
+		return nil
+	}
+}
+
+// WithPacketConn runs serve with the packet connection, for example of an UDP
+// based DNS or syslog server, in its own go routine. The connection gets closed
+// during shutdown, which must cause serve to return.
+func WithPacketConn(name string, pc net.PacketConn, serve func(net.PacketConn) error) Config {
+	return func(s *services) error {
+		s.starts = append(s.starts, named{
+			name: name,
+			startFn: func(context.Context) error {
+				if err := serve(pc); err != nil && !errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				return nil
+			},
+			stopFn: func(context.Context) error {
+				if err := pc.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				return nil
+			},
+		})
+		return nil
+	}
+}
+
+// Server defines a server which accepts connections on a listener and which
+// can be shut down gracefully. http.Server implements it. A Server can
+// additionally implement
+//
+//	SetLog(info, err func(format string, args ...interface{}))
+//
+// to receive Options.LogInfo and Options.LogError before Serve gets called.
+type Server interface {
+	// Serve blocks until the server has been shut down or closed. It owns the
+	// listener and must close it.
+	Serve(net.Listener) error
+	// Shutdown gracefully shuts down the server without interrupting active
+	// connections. It must return ctx.Err() when the context is done before
+	// all connections have finished.
+	Shutdown(ctx context.Context) error
+	// Close forcefully closes all connections.
+	Close() error
+}
+
+type server struct {
+	name string // address or name used in logs
+	addr string
+	lis  net.Listener // optional, already bound listener
+	Server
+	hs                *http.Server // set for HTTP servers
+	certFile, keyFile string
+	tlsFromConfig     bool          // serves TLS with the certificates of hs.TLSConfig
+	network           string        // "unix" for Unix domain sockets, networkUDP, networkDualStack or empty for TCP
+	socketMode        os.FileMode   // file permissions of a Unix domain socket
+	listenFailed      atomic.Bool   // excludes the server from the shutdown
+	ownHS             bool          // hs has been created by this package
+	reusePort         bool          // listens with SO_REUSEPORT
+	trackConns        bool          // conns counts the connections via hs.ConnState
+	shutdownTimeout   time.Duration // overrides Options.ShutdownTimeout
+	ordered           bool          // shuts down with WithShutdownSequence or WithDependsOn
+	conns             atomic.Int64
+}
+
+func newHTTPServer(hs *http.Server, certFile, keyFile string) *server {
+	return &server{
+		name:     hs.Addr,
+		addr:     hs.Addr,
+		Server:   hs,
+		hs:       hs,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+}
+
+// newHTTPServerTLS works like newHTTPServer for a TLS server and validates
+// that the certificates have been provided.
+func newHTTPServerTLS(hs *http.Server, certFile, keyFile string) (*server, error) {
+	srv := newHTTPServer(hs, certFile, keyFile)
+	switch tc := hs.TLSConfig; {
+	case certFile != "" && keyFile != "":
+	case tc != nil && (len(tc.Certificates) > 0 || tc.GetCertificate != nil || tc.GetConfigForClient != nil):
+		srv.tlsFromConfig = true
+	default:
+		return nil, fmt.Errorf("server %s: TLS requires a certificate and key file or a TLSConfig with certificates", hs.Addr)
+	}
+	return srv, nil
+}
+
+// newOwnHTTPServer works like newHTTPServer for a http.Server created by this
+// package. Its BaseContext gets set when starting.
+func newOwnHTTPServer(hs *http.Server, certFile, keyFile string) *server {
+	s := newHTTPServer(hs, certFile, keyFile)
+	s.ownHS = true
+	return s
+}
+
+func (s *server) isTLS() bool {
+	return s.hs != nil && (s.tlsFromConfig || s.certFile != "" && s.keyFile != "")
+}
+
+func (s *server) listen(ctx context.Context, opt Options) (net.Listener, error) {
+	if s.lis != nil {
+		return s.lis, nil
+	}
+	if s.network == "unix" {
+		return listenUnix(ctx, opt, s.addr, s.socketMode)
+	}
+	if s.network == networkUDP {
+		return listenPacket(ctx, opt, s.addr)
+	}
+	if s.network == networkDualStack {
+		_, port, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return nil, err
+		}
+		return listenDualStack(ctx, opt, s, port)
+	}
+	addr := s.addr
+	if addr == "" && s.hs != nil {
+		addr = ":http"
+		if s.isTLS() {
+			addr = ":https"
+		}
+	}
+	lc := opt.listenConfig()
+	if s.reusePort {
+		control := lc.Control
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return reusePortControl(network, address, c)
+		}
+	} else if opt.ListenFunc != nil {
+		return opt.ListenFunc("tcp", addr)
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// listenConfig returns a copy of Options.ListenConfig or the zero value.
+func (opt Options) listenConfig() net.ListenConfig {
+	if opt.ListenConfig != nil {
+		return *opt.ListenConfig
+	}
+	return net.ListenConfig{}
+}
+
+// closeOnShutdown sets the header "Connection: close" on all responses once
+// shuttingDown reports true, so that clients and proxies stop reusing their
+// keep-alive connections while the server drains.
+func closeOnShutdown(shuttingDown *atomic.Bool, h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			w.Header().Set("Connection", "close")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drainLogInterval defines how often the remaining connections get logged
+// while a server drains.
+const drainLogInterval = time.Second
+
+// trackConn counts the active connections, see http.Server.ConnState.
+func (s *server) trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.conns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		s.conns.Add(-1)
+	}
+}
+
+// logDraining logs and emits the number of active connections until all of
+// them have been closed or done gets closed.
+func (s *server) logDraining(opt Options, rep *reporter, done <-chan struct{}) {
+	t := time.NewTicker(drainLogInterval)
+	defer t.Stop()
+	start := time.Now()
+	for {
+		n := s.conns.Load()
+		if n <= 0 {
+			return
+		}
+		logInfo(opt, logAttrs(LogPhaseShutdown, s.name, s.addr, nil), "server %s draining for %s, %d connections remaining", s.name, time.Since(start).Round(time.Millisecond), n)
+		rep.draining(s.name, int(n))
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// warnSlowShutdown logs an error once the shutdown of the server takes longer
+// than Options.SlowShutdownThreshold. The returned function stops it.
+func (s *server) warnSlowShutdown(opt Options) (stop func() bool) {
+	threshold := opt.SlowShutdownThreshold
+	if threshold <= 0 {
+		timeout := opt.ShutdownTimeout
+		if s.shutdownTimeout > 0 {
+			timeout = s.shutdownTimeout
+		}
+		threshold = timeout / 2
+	}
+	if threshold <= 0 {
+		return func() bool { return false }
+	}
+	t := time.AfterFunc(threshold, func() {
+		err := fmt.Errorf("slow shutdown exceeding %s", threshold)
+		if s.trackConns {
+			logError(opt, logAttrs(LogPhaseShutdown, s.name, s.addr, err), "server %s still shutting down after %s, %d connections remaining", s.name, threshold, s.conns.Load())
+			return
+		}
+		logError(opt, logAttrs(LogPhaseShutdown, s.name, s.addr, err), "server %s still shutting down after %s", s.name, threshold)
+	})
+	return t.Stop
+}
+
+// listenRetry calls listen and retries it according to Options.BindRetry.
+func (s *server) listenRetry(ctx context.Context, opt Options) (net.Listener, error) {
+	lis, err := s.listen(ctx, opt)
+	backoff := opt.BindRetry.Backoff
+	for attempt := 1; err != nil && errors.Is(err, syscall.EADDRINUSE) && attempt <= opt.BindRetry.Attempts; attempt++ {
+		logError(opt, logAttrs(LogPhaseStart, s.name, s.addr, err), "server %s address in use, retrying in %s (attempt %d/%d)", s.name, backoff, attempt, opt.BindRetry.Attempts)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		backoff *= 2
+		lis, err = s.listen(ctx, opt)
+	}
+	return lis, err
+}
+
+func (s *server) serve(opt Options, lis net.Listener) error {
+	if s.isTLS() {
+		logInfo(opt, logAttrs(LogPhaseStart, s.name, s.addr, nil), "starting ServeTLS at %q", s.name)
+		return s.hs.ServeTLS(lis, s.certFile, s.keyFile)
+	}
+	if ls, ok := s.Server.(interface {
+		SetLog(info, err func(format string, args ...interface{}))
+	}); ok {
+		ls.SetLog(func(format string, args ...interface{}) {
+			logInfo(opt, logAttrs("", s.name, s.addr, nil), format, args...)
+		}, func(format string, args ...interface{}) {
+			logError(opt, logAttrs("", s.name, s.addr, nil), format, args...)
+		})
+	}
+	logInfo(opt, logAttrs(LogPhaseStart, s.name, s.addr, nil), "starting Serve at %q", s.name)
+	return s.Serve(lis)
+}
+
+// onceCloseListener wraps a net.Listener, protecting it from multiple Close
+// calls.
+type onceCloseListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (oc *onceCloseListener) Close() error {
+	oc.once.Do(func() { oc.closeErr = oc.Listener.Close() })
+	return oc.closeErr
 }
 
 // Config configures the function Go to start and stop servers/services.
 type Config func(*services) error
 
+// Configs combines the configs into one, for example to reuse a bundle of
+// services. The configs get applied in order, the first error stops it.
+func Configs(cs ...Config) Config {
+	return func(s *services) error {
+		for _, c := range cs {
+			if err := c(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// If applies the config only when cond is true, so that optional services can
+// stay in the list of configs.
+func If(cond bool, c Config) Config {
+	return func(s *services) error {
+		if !cond {
+			return nil
+		}
+		return c(s)
+	}
+}
+
+// Maybe returns the config or, when err is not nil, a config failing with err,
+// for example Maybe(newConsumerConfig()). Go then returns err before starting
+// any service.
+func Maybe(c Config, err error) Config {
+	return func(s *services) error {
+		if err != nil {
+			return err
+		}
+		return c(s)
+	}
+}
+
 type named struct {
-	name string
-	io.Closer
-	startFn func() error
+	name     string
+	closeFn  func(context.Context) error
+	startFn  func(context.Context) error
+	stopFn   func(context.Context) error
+	reloadFn func() error
+	// startReadyFn replaces startFn when the function signals its readiness
+	// itself.
+	startReadyFn func(ready func()) error
+	// supervise restarts startFn when it fails.
+	supervise *supervision
+	// onPanic decides whether a panic of startFn fails all services.
+	onPanic PanicPolicy
+	// ticker logs when startFn has stopped after the shutdown began.
+	ticker bool
 }
 
 type services struct {
-	httpServer    []*httpServer
+	servers       []*server
 	closersBefore []named
 	closersAfter  []named
+	// closersAfterConcurrent run concurrently after closersAfter
+	closersAfterConcurrent []named
+	// closersDuring run concurrently to the servers
+	closersDuring []named
+	preStarts     []named
 	starts        []named
+	prioStarts    []prioStart
+	reloaders     []named
+	finalizers    []named
+	sequence      []sequenceEntry
+	nodes         []dependencyNode
+	// onReady and onShutdown get called once all services are ready and once
+	// the shutdown begins.
+	onReady    []func()
+	onShutdown []func()
 }
 
 // Options use in function Go to apply various optional settings.
 type Options struct {
-	Context  context.Context
-	Signals  []os.Signal
-	LogInfo  func(format string, args ...interface{})
-	LogError func(format string, args ...interface{})
+	// Context is the parent of the contexts passed to all callbacks. Start
+	// functions and servers receive a context which gets canceled when the
+	// shutdown begins or Context gets canceled. Stop functions and closers
+	// receive a context carrying the values of Context which gets canceled
+	// when ShutdownTimeout or CloserTimeout elapses or the shutdown gets
+	// forced. Pre-start functions receive the context passed to Runner.Start,
+	// which is Context when using Go. Go returns the error of an already
+	// canceled Context without starting anything.
+	Context context.Context
+	// Signals trigger the graceful shutdown. Empty means DefaultSignals.
+	Signals []os.Signal
+	// GracefulSignals replaces, when set, Signals. Together with
+	// ForceSignals it gives signals two tiers: the first signal of
+	// GracefulSignals starts the graceful drain, a signal of ForceSignals,
+	// even during the drain, closes everything immediately.
+	GracefulSignals []os.Signal
+	// ForceSignals close all servers immediately, cancel the contexts of the
+	// stop functions and closers and skip PreShutdownDelay, for example
+	// SIGQUIT after SIGTERM. Go returns shortly after, with
+	// ErrShutdownForced when services still run. A second graceful signal
+	// forces the shutdown as well but waits for all services.
+	ForceSignals []os.Signal
+	// DisableSignals lets Go never register for signals of the operating
+	// system, for example when embedded into an application handling the
+	// signals itself. The shutdown then begins once Context gets canceled,
+	// TriggerShutdown fires or a service fails. SignalChan still works.
+	DisableSignals bool
+	LogInfo        func(format string, args ...interface{})
+	LogError       func(format string, args ...interface{})
+	// ShutdownTimeout limits the time each server has to gracefully drain its
+	// connections. Once elapsed the server gets forcefully closed. Zero waits
+	// indefinitely. WithHTTPHandlerTimeout overrides it per server. A
+	// ShutdownTimeoutError summarizes the services not done in time.
+	ShutdownTimeout time.Duration
+	// SlowShutdownThreshold logs an error for each server still shutting
+	// down after this duration, together with its remaining connections,
+	// while it keeps draining. Zero uses half of the ShutdownTimeout of the
+	// server, no warning without a timeout. Servers created by this package
+	// log their remaining connections every second anyway.
+	SlowShutdownThreshold time.Duration
+	// CloserTimeout limits the time each closer and finalizer has to return.
+	// Once elapsed, the closer gets logged as failed and the shutdown moves on
+	// while the closer keeps running in the background. Zero uses
+	// ShutdownTimeout.
+	CloserTimeout time.Duration
+	// OnReload gets called when SIGHUP, which must be listed in Signals, has
+	// been received. Instead of shutting down, the services keep running. The
+	// same applies when a server has been configured with WithReloadableTLS.
+	OnReload func() error
+	// OnSignal gets called with the signal which triggers the shutdown before
+	// the shutdown begins, for example to map it to an exit code. Signals
+	// reloading or forcing the shutdown do not get passed.
+	OnSignal func(os.Signal)
+	// OnListen gets called for each server once its listener has been
+	// created. The name is the configured address and addr the resolved one,
+	// which is useful when listening on port 0. It might be called
+	// concurrently.
+	OnListen func(name string, addr net.Addr)
+	// AfterListen gets called once after all listeners have been bound and
+	// OnListen has been called, but before any server serves, the start
+	// functions run and OnReady gets called. Pre-start functions have already
+	// run. Use it to drop privileges, for example with setuid and setgid,
+	// after binding a privileged port. An error closes the listeners, shuts
+	// down like a failing listener and gets returned.
+	AfterListen func() error
+	// OnReady gets called once after all servers are listening and all start
+	// functions have been launched. It won't be called when a server fails to
+	// listen, unless ContinueOnListenError skips that server.
+	OnReady func()
+	// EnableGracefulRestart starts, on SIGUSR2, the current executable again
+	// and passes the listeners of all servers with an address to it, see
+	// EnvInheritedListeners. The current process then shuts down gracefully.
+	// Only supported on Unix systems.
+	EnableGracefulRestart bool
+	// StartTimeout defines the time all servers have to listen and all start
+	// functions have to be launched. Once elapsed Go fails with
+	// ErrStartTimeout. Zero means no timeout.
+	StartTimeout time.Duration
+	// ContinueOnListenError keeps the other services running when a server
+	// fails to bind its listener. The error gets logged and the server gets
+	// excluded from the shutdown. By default Go shuts down all services and
+	// returns the error.
+	ContinueOnListenError bool
+	// ListenFunc replaces net.Listen for binding the TCP listeners of all
+	// servers, for example to inject failures in tests or to set socket
+	// options. It does not apply to Unix domain sockets, already bound or
+	// inherited listeners and WithHTTPHandlerReusePort.
+	ListenFunc func(network, addr string) (net.Listener, error)
+	// ListenConfig binds the listeners created by this package, for example
+	// to set the TCP keep-alive or socket options via Control. It applies to
+	// the servers registered with an address or a Unix domain socket path,
+	// including WithHTTPHandlerReusePort, WithHTTPHandlerDualStack,
+	// WithMuxListener and WithFastCGI. It does not apply to WithHTTPListener,
+	// WithSystemdSockets, WithPacketConn, inherited listeners and, when
+	// ListenFunc is set, to the TCP listeners.
+	ListenConfig *net.ListenConfig
+	// BindRetry retries binding a listener whose address is still in use, for
+	// example by the previous process during a deploy.
+	BindRetry BindRetry
+	// PreShutdownDelay delays the shutdown after a signal while all services
+	// keep running. Combined with a failing readiness probe, see
+	// WithHealthEndpoint, load balancers stop routing requests before the
+	// servers stop accepting them. Servers created by this package respond
+	// with "Connection: close" once the shutdown begins, so that proxies stop
+	// reusing their keep-alive connections. Count the delay into the grace
+	// period of the environment, for example Kubernetes
+	// terminationGracePeriodSeconds.
+	PreShutdownDelay time.Duration
+	// ShutdownJitter adds a random delay between zero and ShutdownJitter to
+	// PreShutdownDelay, so that instances receiving a signal at the same time,
+	// for example during a rolling deploy, do not all drain at once. Zero
+	// means no jitter.
+	ShutdownJitter time.Duration
+	// ShutdownOrder defines the order of the shutdown steps. Each group of
+	// steps starts once the previous group has finished and the steps of a
+	// group run concurrently. Each step must be listed exactly once. Empty
+	// means DefaultShutdownOrder. For example, to stop the workers before the
+	// servers:
+	//
+	//	[][]ShutdownStep{
+	//		{StepClosersBefore},
+	//		{StepStopFuncs},
+	//		{StepServers},
+	//		{StepClosersAfter},
+	//		{StepClosersAfterConcurrent},
+	//	}
+	ShutdownOrder [][]ShutdownStep
+	// ShutdownLIFO closes the closers before and the closers after in reverse
+	// registration order, like deferred calls, so that resources get released
+	// in the opposite order they were acquired. It only changes the order
+	// within each of these steps: servers, stop functions and concurrent
+	// closers after still follow ShutdownOrder and finalizers still run in
+	// registration order.
+	ShutdownLIFO bool
+	// OnPhase gets called once for each phase of the shutdown, in order, for
+	// example to deregister from a service discovery at a specific phase. The
+	// shutdown waits for it to return.
+	OnPhase func(Phase)
+	// OnEvent gets called for each lifecycle change of a service. Useful to
+	// record metrics. It might be called concurrently.
+	OnEvent func(Event)
+	// Logger receives the same messages as LogInfo and LogError together with
+	// attributes using the LogKey* keys and the LogPhase* phases. LogInfo and
+	// LogError keep working when a Logger is set.
+	Logger *slog.Logger
+	// WindowsServiceName enables, when the process runs as a Windows service,
+	// the integration with the Service Control Manager. Stop and shutdown
+	// requests then trigger the graceful shutdown and the service gets
+	// reported as running once ready. Ignored on other platforms.
+	WindowsServiceName string
+	// AllowNoServices lets Go wait for a signal even when no services have been
+	// configured. By default Go returns ErrNoServices.
+	AllowNoServices bool
+	// AllowDuplicateAddresses lets several servers use the same address, for
+	// example with SO_REUSEPORT. By default Go returns ErrDuplicateAddress
+	// before binding any listener.
+	AllowDuplicateAddresses bool
+	// SignalChan replaces, when set, the signals of the operating system and
+	// Options.Signals. Go then handles the signals received from it, which
+	// allows tests to send signals deterministically.
+	SignalChan <-chan os.Signal
+	// TriggerShutdown begins, once it receives a value or gets closed, the
+	// same graceful shutdown as a signal. Further values have no effect.
+	TriggerShutdown <-chan struct{}
+	// ShutdownReportPath defines a file to which Go writes, once all services
+	// have been stopped, the Report and the error of the run as JSON. Useful
+	// to debug slow shutdowns when the logs got lost. A failing write gets
+	// logged.
+	ShutdownReportPath string
+	// IgnoreErrors contains errors which mean a clean exit when returned by a
+	// start function, a closer or a finalizer, matched with errors.Is. Besides
+	// them, start functions may return http.ErrServerClosed and all of them
+	// io.EOF, also wrapped, unless EOFIsError is set.
+	IgnoreErrors []error
+	// ReturnSignalError lets Go return a *SignalError carrying the signal
+	// which triggered the shutdown, joined with the errors of the run, so
+	// that ExitCode can derive the exit code from it.
+	ReturnSignalError bool
+	// EOFIsError treats io.EOF returned by start functions, closers and
+	// finalizers as an error.
+	EOFIsError bool
+	// MaxShutdownDuration limits the whole shutdown, from its beginning
+	// including PreShutdownDelay until the last closer after has returned.
+	// Once elapsed, the phase in progress gets logged and aborted like a
+	// forced shutdown, the remaining closers get skipped, the remaining
+	// servers get closed without draining and the run fails with
+	// ErrMaxShutdownDuration. Go returns shortly after, even when services
+	// ignore the cancellation, so that the process exits before the
+	// environment kills it. Finalizers run once all services have returned.
+	// Zero means no limit.
+	MaxShutdownDuration time.Duration
+}
+
+// BindRetry defines how often binding a listener gets retried when its address
+// is already in use. The backoff doubles after each attempt. Other errors, like
+// missing permissions, don't get retried.
+type BindRetry struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// ErrNoServices gets returned when no servers, start functions, closers,
+// pre-start functions or finalizers have been configured, see
+// Options.AllowNoServices.
+var ErrNoServices = errors.New("no services configured")
+
+// ErrDuplicateAddress gets returned when several servers have been configured
+// with the same address, see Options.AllowDuplicateAddresses.
+var ErrDuplicateAddress = errors.New("duplicate address")
+
+// ErrStartTimeout gets returned when the services are not ready within
+// Options.StartTimeout.
+var ErrStartTimeout = errors.New("start timeout exceeded")
+
+// ErrMaxShutdownDuration gets returned when the shutdown takes longer than
+// Options.MaxShutdownDuration.
+var ErrMaxShutdownDuration = errors.New("maximum shutdown duration exceeded")
+
+// ErrStartup matches, using errors.Is, a ServiceError of a service which failed
+// to start or while running, for example a server failing to listen.
+var ErrStartup = errors.New("service failed to start")
+
+// ErrShutdown matches, using errors.Is, a ServiceError of a service which
+// failed to stop cleanly.
+var ErrShutdown = errors.New("service failed to shut down")
+
+// ErrShutdownForced gets returned when services still run shortly after a
+// signal of Options.ForceSignals.
+var ErrShutdownForced = errors.New("shutdown forced")
+
+// DefaultSignals returns the signals Go listens to when Options.Signals is
+// empty. SIGKILL is not part of it because it cannot be caught.
+func DefaultSignals() []os.Signal {
+	return []os.Signal{syscall.SIGINT, syscall.SIGTERM}
 }
 
 // Go starts the listed servers/services and terminates them gracefully when
-// receiving a (default) SIGINT/TERM/KILL os.Signal.
+// receiving a (default) SIGINT/TERM os.Signal. The shutdown first calls all
+// closers before in registration order, then shuts down all servers and stop
+// functions concurrently and, once all of them have returned, calls all
+// closers after in registration order and finally all concurrent closers
+// after. Options.ShutdownOrder changes this order. A second signal received
+// during the shutdown aborts the graceful drain and closes all servers
+// immediately, see Options.ForceSignals to use a distinct signal for it.
+//
+// The closers also run when a server fails to listen or a service fails
+// right after the start. When a config, a pre-start function or the
+// validation of the options fails, Go returns before binding any listener and
+// skips all closers. Finalizers, see WithFinalizer, run in every case.
 func Go(opt Options, configs ...Config) error {
-	if opt.LogInfo == nil {
-		opt.LogInfo = func(string, ...interface{}) {}
-	}
-	if opt.LogError == nil {
-		opt.LogError = func(string, ...interface{}) {}
-	}
-	if opt.Context == nil {
-		opt.Context = context.Background()
+	_, err := GoResult(opt, configs...)
+	return err
+}
+
+// GoResult works like Go and additionally returns a Report describing which
+// services have been started and stopped.
+func GoResult(opt Options, configs ...Config) (Report, error) {
+	if len(opt.GracefulSignals) > 0 {
+		opt.Signals = opt.GracefulSignals
 	}
 	if len(opt.Signals) == 0 {
-		opt.Signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL}
+		opt.Signals = DefaultSignals()
 	}
-
-	var runSrvs services
-	for _, srvFn := range configs {
-		if err := srvFn(&runSrvs); err != nil {
-			return err
+	r := NewRunner(opt, configs...)
+	opt = r.opt
+	if opt.EnableGracefulRestart {
+		if restartSignal == nil {
+			logError(opt, logAttrs(LogPhaseRestart, "", "", nil), "graceful restart is not supported on this platform")
+		} else {
+			opt.Signals = append(opt.Signals[:len(opt.Signals):len(opt.Signals)], restartSignal)
+		}
+	}
+	for _, sig := range append(opt.Signals[:len(opt.Signals):len(opt.Signals)], opt.ForceSignals...) {
+		if sig == syscall.SIGKILL && !opt.DisableSignals {
+			logError(opt, logAttrs(LogPhaseSignal, "", "", nil), "signal %s cannot be caught, graceful shutdown won't run on it", sig)
 		}
 	}
 
-	ctx, done := context.WithCancel(opt.Context)
-	g, gctx := errgroup.WithContext(ctx)
-
-	// goroutine to check for signals to gracefully finish all functions
-	g.Go(func() (gErr error) {
-		sigChan := make(chan os.Signal, 1)
+	sigChan := make(chan os.Signal, 1)
+	if opt.SignalChan == nil && !opt.DisableSignals {
 		signal.Notify(sigChan, opt.Signals...)
+		if len(opt.ForceSignals) > 0 {
+			signal.Notify(sigChan, opt.ForceSignals...)
+		}
+	}
+	// all exit paths, including a failing service, remove the registration
+	defer signal.Stop(sigChan)
+	defer startWindowsService(&r.opt, sigChan)()
 
-		defer func() {
-			for _, c := range runSrvs.closersBefore {
-				opt.LogInfo("closing before: %q", c.name)
-				if err := c.Close(); err != nil && err != io.EOF {
-					opt.LogError("service %q failed to close with error: %s", c.name, err)
-					if gErr == nil {
-						gErr = err
-					}
-				}
-			}
+	if err := r.Start(opt.Context); err != nil {
+		return r.result(err)
+	}
 
-			for _, srv := range runSrvs.httpServer {
-				opt.LogInfo("shutting down server %s", srv.Addr)
-				if err := srv.Shutdown(gctx); err != nil {
-					opt.LogError("service %s failed to shutdown with error: %s", srv.Addr, err)
-					if gErr == nil {
-						gErr = err
-					}
+	var stopping bool
+	var stopSignal os.Signal
+	withSignal := func(err error) error {
+		if !opt.ReturnSignalError || stopSignal == nil {
+			return err
+		}
+		if err == nil {
+			return &SignalError{Signal: stopSignal}
+		}
+		return errors.Join(err, &SignalError{Signal: stopSignal})
+	}
+	var abandon <-chan time.Time
+	var abandonErr error
+	var abandonTimer *time.Timer
+	defer func() {
+		if abandonTimer != nil {
+			abandonTimer.Stop()
+		}
+	}()
+	// abandonAfterGrace gives the services a moment to return after a forced
+	// shutdown and lets Go return without them afterwards.
+	abandonAfterGrace := func(err error) {
+		if abandonTimer == nil {
+			abandonTimer = time.NewTimer(closerGrace)
+			abandon = abandonTimer.C
+			abandonErr = err
+		}
+	}
+	handleSignal := func(sig os.Signal) {
+		if isForceSignal(opt, sig) {
+			logInfo(opt, logAttrs(LogPhaseSignal, "", "", nil), "received force signal: %s, closing all services", sig)
+			if !stopping {
+				if opt.OnSignal != nil {
+					opt.OnSignal(sig)
 				}
+				stopping = true
+				stopSignal = sig
+				r.setReason(ReasonSignal)
+				r.trigger()
 			}
-			for _, c := range runSrvs.closersAfter {
-				opt.LogInfo("closing after: %q", c.name)
-				if err := c.Close(); err != nil && err != io.EOF {
-					opt.LogError("service %q failed to close with error: %s", c.name, err)
-					if gErr == nil {
-						gErr = err
-					}
-				}
+			r.force()
+			abandonAfterGrace(ErrShutdownForced)
+			return
+		}
+		// Reload and restart signals never count as the second signal.
+		if sig == syscall.SIGHUP && (opt.OnReload != nil || len(r.srvs.reloaders) > 0) {
+			logInfo(opt, logAttrs(LogPhaseReload, "", "", nil), "received signal: %s, reloading", sig)
+			r.reload()
+			return
+		}
+		restart := opt.EnableGracefulRestart && sig == restartSignal
+		if restart && stopping {
+			logInfo(opt, logAttrs(LogPhaseRestart, "", "", nil), "received signal: %s during the shutdown, ignoring it", sig)
+			return
+		}
+		if stopping {
+			// A second signal aborts the graceful drain and closes the servers.
+			logInfo(opt, logAttrs(LogPhaseShutdown, "", "", nil), "second signal received, forcing shutdown")
+			r.force()
+			return
+		}
+		if restart {
+			pid, err := r.rs.restart()
+			if err != nil {
+				logError(opt, logAttrs(LogPhaseRestart, "", "", err), "graceful restart failed with error: %s", err)
+				return
 			}
-		}()
+			logInfo(opt, logAttrs(LogPhaseRestart, "", "", nil), "graceful restart started new process %d", pid)
+		}
+		logInfo(opt, logAttrs(LogPhaseSignal, "", "", nil), "received signal: %s", sig)
+		if opt.OnSignal != nil {
+			opt.OnSignal(sig)
+		}
+		stopping = true
+		stopSignal = sig
+		r.setReason(ReasonSignal)
+		r.trigger()
+	}
 
+	trigger := opt.TriggerShutdown
+	exceeded := r.exceeded
+	for {
 		select {
+		case <-exceeded:
+			exceeded = nil
+			abandonAfterGrace(ErrMaxShutdownDuration)
+		case <-abandon:
+			logError(opt, logAttrs(LogPhaseShutdown, "", "", abandonErr), "%s, abandoning the services still running", abandonErr)
+			return r.result(withSignal(abandonErr))
+		case <-trigger:
+			trigger = nil
+			if !stopping {
+				logInfo(opt, logAttrs(LogPhaseSignal, "", "", nil), "shutdown triggered")
+				stopping = true
+				r.trigger()
+			}
+		case sig := <-opt.SignalChan:
+			handleSignal(sig)
 		case sig := <-sigChan:
-			opt.LogInfo("received signal: %s", sig)
-			signal.Stop(sigChan)
-			done()
-		case <-gctx.Done():
-			opt.LogInfo("context canceled, closing signal goroutine")
-			return gctx.Err()
+			handleSignal(sig)
+		case <-r.Done():
+			return r.result(withSignal(r.Wait()))
+		}
+	}
+}
+
+// empty reports whether no services have been configured.
+func (s services) empty() bool {
+	return len(s.servers) == 0 && len(s.closersBefore) == 0 && len(s.closersAfter) == 0 &&
+		len(s.closersAfterConcurrent) == 0 && len(s.starts) == 0 && len(s.prioStarts) == 0 &&
+		len(s.sequence) == 0 && len(s.nodes) == 0 && len(s.closersDuring) == 0 &&
+		len(s.preStarts) == 0 && len(s.reloaders) == 0 && len(s.finalizers) == 0
+}
+
+// checkDuplicateAddresses returns an error when two servers have the same
+// address. Port 0 never conflicts, an empty or unspecified host like 0.0.0.0
+// or :: conflicts with any host on the same port.
+func (s services) checkDuplicateAddresses() error {
+	type bound struct {
+		network, host, port string
+		srv                 *server
+	}
+	var seen []bound
+	for _, srv := range s.servers {
+		if srv.addr == "" || srv.reusePort {
+			continue
+		}
+		b := bound{network: srv.network, host: srv.addr, srv: srv}
+		if b.network == networkDualStack {
+			b.network = ""
+		}
+		// other addresses, like the paths of Unix domain sockets, must match
+		// exactly
+		if host, port, err := net.SplitHostPort(srv.addr); err == nil && b.network != "unix" {
+			if port == "0" {
+				continue
+			}
+			b.host, b.port = normalizeHost(host), port
+		}
+		for _, o := range seen {
+			if o.network == b.network && o.port == b.port && (o.host == b.host || o.host == "" || b.host == "") {
+				return fmt.Errorf("%w %q configured by %q and %q", ErrDuplicateAddress, srv.addr, o.srv.name, srv.name)
+			}
+		}
+		seen = append(seen, b)
+	}
+	return nil
+}
+
+// normalizeHost returns host in its canonical form and an empty string for a
+// wildcard host.
+func normalizeHost(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return strings.ToLower(host)
+	case ip.IsUnspecified():
+		return ""
+	}
+	return ip.String()
+}
+
+// readiness tracks the services which have not yet signaled to be ready.
+type readiness struct {
+	mu      sync.Mutex
+	pending []string
+	ready   chan struct{}
+}
+
+func newReadiness(s services) *readiness {
+	r := &readiness{ready: make(chan struct{})}
+	for _, srv := range s.servers {
+		r.pending = append(r.pending, srv.name)
+	}
+	for _, st := range s.starts {
+		r.pending = append(r.pending, st.name)
+	}
+	for _, ps := range s.prioStarts {
+		r.pending = append(r.pending, ps.name)
+	}
+	if len(r.pending) == 0 {
+		close(r.ready)
+	}
+	return r
+}
+
+func (r *readiness) done(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, p := range r.pending {
+		if p == name {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			if len(r.pending) == 0 {
+				close(r.ready)
+			}
+			return
+		}
+	}
+}
+
+// wait calls Options.OnReady once all services are ready. It fails with
+// ErrStartTimeout when the services are not ready within
+// Options.StartTimeout.
+func (r *readiness) wait(ctx context.Context, opt Options, onReady []func()) error {
+	var timeout <-chan time.Time
+	if opt.StartTimeout > 0 {
+		t := time.NewTimer(opt.StartTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-r.ready:
+		for _, fn := range onReady {
+			fn()
+		}
+		if opt.OnReady != nil {
+			opt.OnReady()
 		}
 		return nil
-	})
+	case <-timeout:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		logError(opt, logAttrs(LogPhaseStart, "", "", ErrStartTimeout), "services %q not ready within %s", r.pending, opt.StartTimeout)
+		return fmt.Errorf("services %q not ready within %s: %w", r.pending, opt.StartTimeout, ErrStartTimeout)
+	case <-ctx.Done():
+		return nil
+	}
+}
 
-	for _, srv := range runSrvs.httpServer {
-		srv := srv
-		g.Go(func() error {
-			if srv.TLSConfig != nil && srv.CertFile != "" && srv.KeyFile != "" {
-				opt.LogInfo("starting ListenAndServeTLS at %q", srv.Addr)
-				if err := srv.ListenAndServeTLS(srv.CertFile, srv.KeyFile); err != nil && err != http.ErrServerClosed {
-					return err
-				}
-				return nil
+// closeAll closes all closers in order and returns each failure wrapped with
+// the name of the closer.
+func closeAll(ctx context.Context, opt Options, rep *reporter, p Phase, key, phase string, closers []named) (errs []error) {
+	for _, c := range closers {
+		logInfo(opt, logAttrs(key, c.name, "", nil), "%s: %q", phase, c.name)
+		rep.stopping(c.name)
+		if err := callClose(ctx, opt, c); !cleanClose(opt, err) {
+			logError(opt, logAttrs(key, c.name, "", err), "service %q failed to close with error: %s", c.name, err)
+			rep.failed(c.name, err)
+			errs = append(errs, wrapService(c.name, p, err))
+			continue
+		}
+		rep.stopped(c.name)
+	}
+	return errs
+}
+
+// closeConcurrent closes all closers concurrently and returns each failure, in
+// registration order, wrapped with the name of the closer.
+func closeConcurrent(ctx context.Context, opt Options, rep *reporter, p Phase, key, phase string, closers []named) []error {
+	results := make([][]error, len(closers))
+	var wg sync.WaitGroup
+	for i, c := range closers {
+		wg.Add(1)
+		go func(i int, c named) {
+			defer wg.Done()
+			results[i] = closeAll(ctx, opt, rep, p, key, phase, []named{c})
+		}(i, c)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, r := range results {
+		errs = append(errs, r...)
+	}
+	return errs
+}
+
+// shutdownServers concurrently shuts down all servers. The errors get
+// returned in registration order.
+func shutdownServers(ctx context.Context, opt Options, rep *reporter, servers []*server) []error {
+	results := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		if srv.listenFailed.Load() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, srv *server) {
+			defer wg.Done()
+			logInfo(opt, logAttrs(LogPhaseShutdown, srv.name, srv.addr, nil), "shutting down server %s", srv.name)
+			rep.stopping(srv.name)
+			if srv.trackConns {
+				done := make(chan struct{})
+				defer close(done)
+				go srv.logDraining(opt, rep, done)
 			}
-			opt.LogInfo("starting ListenAndServe at %q", srv.Addr)
-			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				return err
+			defer srv.warnSlowShutdown(opt)()
+			if err := shutdownServer(ctx, opt, srv); err != nil {
+				logError(opt, logAttrs(LogPhaseShutdown, srv.name, srv.addr, err), "service %s failed to shutdown with error: %s", srv.name, err)
+				rep.failed(srv.name, err)
+				results[i] = wrapService(srv.name, PhaseServers, err)
+				return
 			}
-			return nil
-		})
+			rep.stopped(srv.name)
+		}(i, srv)
 	}
+	wg.Wait()
+	return nonNil(results)
+}
 
-	for _, srv := range runSrvs.starts {
-		srv := srv
-		g.Go(func() error {
-			opt.LogInfo("starting %q", srv.name)
-			if err := srv.startFn(); err != nil && err != http.ErrServerClosed && err != io.EOF {
-				return err
+// stopStarts concurrently stops all start functions having a stop function and
+// stops the priority groups in reverse order. The errors get returned in
+// registration order.
+func stopStarts(ctx context.Context, opt Options, rep *reporter, starts []named, groups []*prioGroup) []error {
+	results := make([]error, len(starts))
+	var wg sync.WaitGroup
+	for i, st := range starts {
+		if st.stopFn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, st named) {
+			defer wg.Done()
+			logInfo(opt, logAttrs(LogPhaseShutdown, st.name, "", nil), "stopping %q", st.name)
+			rep.stopping(st.name)
+			if err := stopFunc(ctx, opt, st); err != nil {
+				logError(opt, logAttrs(LogPhaseShutdown, st.name, "", err), "service %q failed to stop with error: %s", st.name, err)
+				rep.failed(st.name, err)
+				results[i] = wrapService(st.name, PhaseStopFuncs, err)
 			}
-			return nil
-		})
+		}(i, st)
+	}
+	var prioErrs []error
+	if len(groups) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prioErrs = stopPrioGroups(ctx, opt, rep, groups)
+		}()
+	}
+	wg.Wait()
+	return append(nonNil(results), prioErrs...)
+}
+
+func nonNil(errs []error) []error {
+	var nn []error
+	for _, err := range errs {
+		if err != nil {
+			nn = append(nn, err)
+		}
+	}
+	return nn
+}
+
+// shutdownContext returns the context for shutting down a server or service.
+// It must not derive from the errgroup context because that one has already
+// been canceled when the shutdown starts. The parent gets canceled when a
+// second signal forces the shutdown.
+func shutdownContext(parent context.Context, opt Options) (context.Context, context.CancelFunc) {
+	if opt.ShutdownTimeout > 0 {
+		return context.WithTimeout(parent, opt.ShutdownTimeout)
 	}
+	return context.WithCancel(parent)
+}
+
+// shutdownServer gracefully shuts down srv and closes it when the
+// ShutdownTimeout elapses or the shutdown has been forced.
+func shutdownServer(parent context.Context, opt Options, srv *server) (err error) {
+	defer recoverPanic(opt, srv.name, &err)
+	if srv.shutdownTimeout > 0 {
+		opt.ShutdownTimeout = srv.shutdownTimeout
+	}
+	ctx, cancel := shutdownContext(parent, opt)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	switch {
+	case err == context.DeadlineExceeded:
+		logError(opt, logAttrs(LogPhaseShutdown, srv.name, srv.addr, err), "service %s failed to shutdown within %s, closing it", srv.name, opt.ShutdownTimeout)
+	case err == context.Canceled && parent.Err() != nil:
+		logError(opt, logAttrs(LogPhaseShutdown, srv.name, srv.addr, err), "service %s shutdown forced, closing it", srv.name)
+	default:
+		return err
+	}
+	if cErr := srv.Close(); cErr != nil {
+		return cErr
+	}
+	return exceeded(ctx, opt.ShutdownTimeout, err)
+}
 
-	return g.Wait()
+func stopFunc(parent context.Context, opt Options, st named) (err error) {
+	defer recoverPanic(opt, st.name, &err)
+	ctx, cancel := shutdownContext(parent, opt)
+	defer cancel()
+	return exceeded(ctx, opt.ShutdownTimeout, st.stopFn(ctx))
+}
+
+func callStart(ctx context.Context, opt Options, st named) (err error) {
+	defer recoverPanic(opt, st.name, &err)
+	return st.startFn(ctx)
+}
+
+// closerGrace defines how long callClose waits for a closer after its
+// context has been canceled.
+const closerGrace = 50 * time.Millisecond
+
+// callClose calls the closer in its own go routine and stops waiting for it
+// once Options.CloserTimeout, or otherwise Options.ShutdownTimeout, elapses or
+// the shutdown gets forced. An abandoned closer keeps running.
+func callClose(parent context.Context, opt Options, c named) error {
+	timeout := opt.CloserTimeout
+	if timeout <= 0 {
+		timeout = opt.ShutdownTimeout
+	}
+	ctx, cancel := context.WithCancel(parent)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	}
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { errc <- err }()
+		defer recoverPanic(opt, c.name, &err)
+		err = c.closeFn(ctx)
+	}()
+	select {
+	case err := <-errc:
+		return exceeded(ctx, timeout, err)
+	case <-ctx.Done():
+	}
+	// a closer honoring its context gets a moment to return
+	t := time.NewTimer(closerGrace)
+	defer t.Stop()
+	select {
+	case err := <-errc:
+		return exceeded(ctx, timeout, err)
+	case <-t.C:
+	}
+	if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return exceeded(ctx, timeout, fmt.Errorf("closer did not return within %s: %w", timeout, ctx.Err()))
+	}
+	return fmt.Errorf("closer abandoned: %w", ctx.Err())
+}
+
+// recoverPanic converts a panic of the service name into an error and assigns
+// it to err. It must be called deferred.
+func recoverPanic(opt Options, name string, err *error) {
+	if r := recover(); r != nil {
+		logError(opt, logAttrs("", name, "", fmt.Errorf("panic: %v", r)), "service %q panicked: %v\n%s", name, r, debug.Stack())
+		*err = &panicError{name: name, value: r}
+	}
+}
+
+type panicError struct {
+	name  string
+	value interface{}
+}
+
+func (pe *panicError) Error() string {
+	return fmt.Sprintf("service %q panicked: %v", pe.name, pe.value)
+}
+
+// cleanExit reports whether err returned by a start function means a clean
+// exit.
+func cleanExit(opt Options, err error) bool {
+	return errors.Is(err, http.ErrServerClosed) || cleanClose(opt, err)
+}
+
+// cleanClose reports whether err returned by a closer means success.
+func cleanClose(opt Options, err error) bool {
+	return err == nil || !opt.EOFIsError && errors.Is(err, io.EOF) || ignoreError(opt, err)
+}
+
+// ignoreError reports whether err matches one of Options.IgnoreErrors.
+func ignoreError(opt Options, err error) bool {
+	for _, ie := range opt.IgnoreErrors {
+		if errors.Is(err, ie) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceError identifies the service which failed and the phase in which it
+// failed. Go returns it, possibly joined with other errors, for failing start
+// functions, servers, stop functions, closers and finalizers. Use errors.As to
+// find it. Finalizers fail in PhaseComplete. When a service fails to start or
+// run, Go returns its error joined with the errors of the following shutdown;
+// errors.Is with ErrStartup and ErrShutdown tells them apart.
+type ServiceError struct {
+	Name  string
+	Phase Phase
+	Err   error
+}
+
+func (se *ServiceError) Error() string {
+	var pe *panicError
+	if errors.As(se.Err, &pe) {
+		// the panic already contains the name
+		return se.Err.Error()
+	}
+	return fmt.Sprintf("service %q: %s", se.Name, se.Err)
+}
+
+func (se *ServiceError) Unwrap() error {
+	return se.Err
+}
+
+// Is reports whether target is ErrStartup for PhaseStart or ErrShutdown for
+// the other phases.
+func (se *ServiceError) Is(target error) bool {
+	switch target {
+	case ErrStartup:
+		return se.Phase == PhaseStart
+	case ErrShutdown:
+		return se.Phase != PhaseStart
+	}
+	return false
+}
+
+// joinErrors joins err and errs, which might be empty.
+func joinErrors(err error, errs []error) error {
+	if len(errs) == 0 {
+		return err
+	}
+	return errors.Join(append([]error{err}, errs...)...)
+}
+
+// wrapService wraps err into a ServiceError.
+func wrapService(name string, p Phase, err error) error {
+	return &ServiceError{Name: name, Phase: p, Err: err}
+}
+
+// wrapError wraps a non-nil err into a ServiceError. It must be called
+// deferred, before recoverPanic.
+func wrapError(name string, p Phase, err *error) {
+	if *err != nil {
+		*err = wrapService(name, p, *err)
+	}
+}
+
+// isForceSignal reports whether sig is one of Options.ForceSignals.
+func isForceSignal(opt Options, sig os.Signal) bool {
+	for _, fs := range opt.ForceSignals {
+		if fs == sig {
+			return true
+		}
+	}
+	return false
 }
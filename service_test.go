@@ -15,15 +15,37 @@
 package runservicerun_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -51,7 +73,7 @@ func (mb *mutextBuffer) String() string {
 }
 
 func (mb *mutextBuffer) log(msg string, args ...interface{}) {
-	fmt.Fprintf(&mb.buf, msg+"\n", args...)
+	fmt.Fprintf(mb, msg+"\n", args...)
 }
 
 func TestGoHappyPath(t *testing.T) {
@@ -62,46 +84,56 @@ func TestGoHappyPath(t *testing.T) {
 		fmt.Fprintf(logBuf, msg+"\n", args...)
 	}
 
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
 	go func() {
+		defer close(done)
 		nullHandler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
 
 		err := runservicerun.Go(runservicerun.Options{
-			Signals:  []os.Signal{syscall.SIGUSR1},
-			LogError: logFn,
-			LogInfo:  logFn,
+			SignalChan:      sigs,
+			LogError:        logFn,
+			LogInfo:         logFn,
+			ShutdownTimeout: time.Second,
 		},
-			runservicerun.WithHTTPHandler(":7878", nullHandler),
+			runservicerun.WithHTTPHandler("127.0.0.1:0", nullHandler),
 			runservicerun.WithHTTPServer(&http.Server{
-				Addr:    ":7879",
+				Addr:    "localhost:0",
 				Handler: nullHandler,
 			}),
-			runservicerun.WithHTTPHandlerTLS(":7880", "testdata/cert.crt", "testdata/key.pem", &tls.Config{InsecureSkipVerify: true}, nullHandler),
+			runservicerun.WithHTTPHandlerTLS("127.0.0.1:0", "testdata/cert.crt", "testdata/key.pem", &tls.Config{InsecureSkipVerify: true}, nullHandler),
 			runservicerun.WithHTTPServerTLS("testdata/cert.crt", "testdata/key.pem", &http.Server{
-				Addr:      ":7881",
+				Addr:      "localhost:0",
 				Handler:   nullHandler,
 				TLSConfig: &tls.Config{InsecureSkipVerify: true},
 			}),
 			runservicerun.WithCloserBefore("testCloserB", ioutil.NopCloser(nil)),
 			runservicerun.WithCloserAfter("testCloserA", ioutil.NopCloser(nil)),
+			runservicerun.WithCloserBeforeContext("testCloserBCtx", func(context.Context) error { return nil }),
+			runservicerun.WithCloserAfterContext("testCloserACtx", func(ctx context.Context) error {
+				if _, ok := ctx.Deadline(); !ok {
+					return errors.New("missing shutdown deadline")
+				}
+				return nil
+			}),
 			runservicerun.WithStartFunc("testStart", func() error { return nil }),
 		)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
-	killAndCheckLog(t, logBuf, `starting "testStart"`,
-		`starting ListenAndServe at ":7878"`,
-		`starting ListenAndServe at ":7879"`,
-		`starting ListenAndServeTLS at ":7880"`,
-		`starting ListenAndServeTLS at ":7881"`,
+	signalAndCheckLog(t, sigs, done, logBuf, `starting "testStart"`,
+		`starting Serve at "127.0.0.1:0"`,
+		`starting Serve at "localhost:0"`,
+		`starting ServeTLS at "127.0.0.1:0"`,
+		`starting ServeTLS at "localhost:0"`,
 		`received signal: user defined signal 1`,
 		`closing before: "testCloserB"`,
-		`shutting down server :7878`,
-		`shutting down server :7879`,
-		`shutting down server :7880`,
-		`shutting down server :7881`,
-		`closing after: "testCloserA"`)
+		`closing before: "testCloserBCtx"`,
+		`shutting down server 127.0.0.1:0`,
+		`shutting down server localhost:0`,
+		`closing after: "testCloserA"`,
+		`closing after: "testCloserACtx"`)
 }
 
 type closeErr struct {
@@ -112,6 +144,11 @@ func (c closeErr) Close() error {
 	return c.err
 }
 
+var (
+	errCloseBefore = errors.New("error close before")
+	errCloseAfter  = errors.New("error close after")
+)
+
 func TestGoShutdownCloseError(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
 
@@ -120,24 +157,34 @@ func TestGoShutdownCloseError(t *testing.T) {
 		fmt.Fprintf(logBuf, msg+"\n", args...)
 	}
 
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
 	go func() {
+		defer close(done)
 		err := runservicerun.Go(runservicerun.Options{
-			Signals:  []os.Signal{syscall.SIGUSR1},
-			LogError: logFn,
-			LogInfo:  logFn,
+			SignalChan: sigs,
+			LogError:   logFn,
+			LogInfo:    logFn,
 		},
-			runservicerun.WithCloserBefore("testCloserB", closeErr{err: errors.New("error close before")}),
-			runservicerun.WithCloserAfter("testCloserA", closeErr{err: errors.New("error close after")}),
+			runservicerun.WithCloserBefore("testCloserB", closeErr{err: errCloseBefore}),
+			runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
 		)
 		if err == nil {
-			t.Fatal("Expected an error in go routine running runservicerun.Go")
+			t.Error("Expected an error in go routine running runservicerun.Go")
+			return
+		}
+		if !errors.Is(err, errCloseBefore) || !errors.Is(err, errCloseAfter) {
+			t.Errorf("expected both close errors, got: %s", err)
 		}
-		if have, want := err.Error(), "error close before"; have != want {
+		if have, want := err.Error(), "service \"testCloserB\": error close before\nservice \"testCloserA\": error close after"; have != want {
 			t.Errorf("\nHave: %s\nWant: %s", have, want)
 		}
+		var se *runservicerun.ServiceError
+		if !errors.As(err, &se) || se.Name != "testCloserB" || se.Phase != runservicerun.PhaseClosersBefore || !errors.Is(se, errCloseBefore) {
+			t.Errorf("unexpected ServiceError: %#v", se)
+		}
 	}()
 
-	killAndCheckLog(t, logBuf, `received signal: user defined signal 1`,
+	signalAndCheckLog(t, sigs, done, logBuf, `received signal: user defined signal 1`,
 		`closing before: "testCloserB"`,
 		`service "testCloserB" failed to close with error: error close before`,
 		`closing after: "testCloserA"`,
@@ -154,32 +201,4259 @@ func TestGoStartFnFailed(t *testing.T) {
 
 	nullHandler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
 	err := runservicerun.Go(runservicerun.Options{
-		Signals:  []os.Signal{syscall.SIGUSR1},
-		LogError: logFn,
-		LogInfo:  logFn,
+		DisableSignals: true,
+		LogError:       logFn,
+		LogInfo:        logFn,
 	},
-		runservicerun.WithHTTPHandler(":7878", nullHandler),
+		runservicerun.WithHTTPHandler("127.0.0.1:0", nullHandler),
 		runservicerun.WithStartFunc("testStart", func() error { return errors.New("startFn failed") }),
 	)
 	if err == nil {
 		t.Fatal("expected an error during start")
 	}
-	if have, want := err.Error(), "startFn failed"; have != want {
+	if have, want := err.Error(), `service "testStart": startFn failed`; have != want {
 		t.Errorf("\nHave: %s\nWant: %s", have, want)
 	}
+	var se *runservicerun.ServiceError
+	if !errors.As(err, &se) || se.Name != "testStart" || se.Phase != runservicerun.PhaseStart {
+		t.Errorf("unexpected ServiceError: %#v", se)
+	}
 
-	killAndCheckLog(t, logBuf, `starting "testStart"`,
+	checkLog(t, logBuf, `starting "testStart"`,
 		`context canceled, closing signal goroutine`,
-		`shutting down server :7878`,
-		`starting ListenAndServe at ":7878"`)
+		`shutting down server 127.0.0.1:0`,
+		`starting Serve at "127.0.0.1:0"`)
 }
 
-func killAndCheckLog(t *testing.T, logStr fmt.Stringer, wantLogLines ...string) {
-	time.Sleep(300 * time.Millisecond)
-	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+func TestGoEarlyFailureClosers(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inUse.Close()
+
+	nullHandler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	tests := map[string]struct {
+		config runservicerun.Config
+		want   string
+	}{
+		"start func fails": {
+			config: runservicerun.WithStartFunc("testStart", func() error { return errors.New("startFn failed") }),
+			want:   "before,after,finalizer",
+		},
+		"listen fails": {
+			config: runservicerun.WithHTTPHandler(inUse.Addr().String(), nullHandler),
+			want:   "before,after,finalizer",
+		},
+		"config fails": {
+			config: runservicerun.WithTicker("tick", 0, nil),
+			want:   "finalizer",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := &orderRecorder{}
+			err := runservicerun.Go(runservicerun.Options{
+				SignalChan: make(chan os.Signal),
+			},
+				runservicerun.WithHTTPHandler("127.0.0.1:0", nullHandler),
+				runservicerun.WithCloserBefore("before", recordCloser{name: "before", rec: rec}),
+				runservicerun.WithCloserAfter("after", recordCloser{name: "after", rec: rec}),
+				runservicerun.WithFinalizer("finalizer", func() error {
+					rec.record("finalizer")
+					return nil
+				}),
+				test.config,
+			)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if have := strings.Join(rec.order, ","); have != test.want {
+				t.Errorf("\nHave: %s\nWant: %s", have, test.want)
+			}
+		})
+	}
+}
+
+func TestGoStartFnPanics(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	nullHandler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	err := runservicerun.Go(runservicerun.Options{
+		DisableSignals: true,
+		LogError:       logBuf.log,
+		LogInfo:        logBuf.log,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", nullHandler),
+		runservicerun.WithStartFunc("testStart", func() error {
+			time.Sleep(50 * time.Millisecond)
+			panic("startFn panicked")
+		}),
+	)
+	if err == nil {
+		t.Fatal("expected an error during start")
+	}
+	if have, want := err.Error(), `service "testStart" panicked: startFn panicked`; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	checkLog(t, logBuf, `starting "testStart"`,
+		`service "testStart" panicked: startFn panicked`,
+		`runtime/debug.Stack`,
+		`shutting down server 127.0.0.1:0`)
+}
+
+func TestStartFuncRecoverFailAll(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	err := runservicerun.Go(runservicerun.Options{
+		DisableSignals: true,
+		LogError:       logBuf.log,
+		LogInfo:        logBuf.log,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithStartFuncRecover("critical", func() error {
+			panic("critical panicked")
+		}, runservicerun.FailAll),
+	)
+	if have, want := fmt.Sprint(err), `service "critical" panicked: critical panicked`; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	checkLog(t, logBuf, `runtime/debug.Stack`, `shutting down server 127.0.0.1:0`)
+}
+
+func TestStartFuncRecoverIsolate(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	panicked := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		DisableSignals: true,
+		LogError:       logBuf.log,
+		LogInfo:        logBuf.log,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})),
+		runservicerun.WithStartFuncRecover("best-effort", func() error {
+			close(panicked)
+			panic("best-effort panicked")
+		}, runservicerun.Isolate),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-panicked
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addrs["127.0.0.1:0"].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatalf("an isolated panic must not fail the runner: %s", err)
+	}
+	checkLog(t, logBuf, `service "best-effort" panicked: best-effort panicked`, `abandoned "best-effort" after its panic`)
+}
+
+func TestGoShutdownWaitsForActiveRequests(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	logBuf := &mutextBuffer{}
+	addrs := make(chan net.Addr, 1)
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnListen:   func(_ string, addr net.Addr) { addrs <- addr },
+			// the active request completes only once the servers shut down
+			OnPhase: func(p runservicerun.Phase) {
+				if p == runservicerun.PhaseServers {
+					close(release)
+				}
+			},
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(handling)
+				<-release
+				w.WriteHeader(http.StatusOK)
+			})),
+		)
+	}()
+	addr := (<-addrs).String()
+
+	respCode := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Error(err)
+			respCode <- 0
+			return
+		}
+		resp.Body.Close()
+		respCode <- resp.StatusCode
+	}()
+	<-handling
+	sigs <- syscall.SIGUSR1
+
+	if have, want := <-respCode, http.StatusOK; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+	t.Log(logBuf)
+}
+
+func TestGoSecondSignalForcesShutdown(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	logBuf := &mutextBuffer{}
+	addrs := make(chan net.Addr, 1)
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnListen:   func(_ string, addr net.Addr) { addrs <- addr },
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(handling)
+				select {
+				case <-release:
+				case <-time.After(5 * time.Second):
+				}
+			})),
+		)
+	}()
+	addr := (<-addrs).String()
+
+	reqDone := make(chan struct{})
+	go func() {
+		defer close(reqDone)
+		if resp, err := http.Get("http://" + addr + "/"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-handling
+	sigs <- syscall.SIGUSR1
+	// the unbuffered channel hands the second signal over once the first one
+	// has been handled
+	sigs <- syscall.SIGUSR1
+
+	select {
+	case err := <-goErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second signal did not force the shutdown")
+	}
+	<-reqDone
+	if !strings.Contains(logBuf.String(), "second signal received, forcing shutdown") {
+		t.Errorf("missing log line in:\n%s", logBuf)
+	}
+}
+
+func TestGoReloadSignalDuringDrain(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	addrs := make(chan net.Addr, 1)
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	reloaded := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnListen:   func(_ string, addr net.Addr) { addrs <- addr },
+			OnReload: func() error {
+				close(reloaded)
+				return nil
+			},
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(handling)
+				<-release
+				w.WriteHeader(http.StatusTeapot)
+			})),
+		)
+	}()
+	addr := (<-addrs).String()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Error(err)
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-handling
+	sigs <- syscall.SIGUSR1
+	// a reload signal during the drain must not force the shutdown
+	sigs <- syscall.SIGHUP
+	select {
+	case <-reloaded:
+	case <-time.After(2 * time.Second):
+		t.Error("reload signal not handled during the drain")
+	}
+	close(release)
+
+	if have, want := <-status, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoStartFuncReady(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	var warm int32
+	release := make(chan struct{})
+	stop := make(chan struct{})
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnReady: func() {
+				if atomic.LoadInt32(&warm) != 1 {
+					t.Error("OnReady called before the start function was ready")
+				}
+				close(ready)
+			},
+		},
+			runservicerun.WithStartFuncReady("warmCache", func(ready func()) error {
+				<-release
+				atomic.StoreInt32(&warm, 1)
+				ready()
+				<-stop
+				return nil
+			}),
+			runservicerun.WithCloserBefore("stopWarmCache", closerFunc(func() error {
+				close(stop)
+				return nil
+			})),
+		)
+	}()
+
+	select {
+	case <-ready:
+		t.Fatal("OnReady called before the start function was ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-ready
+
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoStartStopFunc(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan struct{})
+		err := runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+		},
+			runservicerun.WithStartStopFunc("testWorker", func() error {
+				<-stop
+				return nil
+			}, func(context.Context) error {
+				close(stop)
+				return nil
+			}),
+		)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	signalAndCheckLog(t, sigs, done, logBuf, `starting "testWorker"`,
+		`received signal: user defined signal 1`,
+		`stopping "testWorker"`)
+}
+
+func TestGoStartFuncContext(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		err := runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+		},
+			runservicerun.WithStartFuncContext("testWorker", func(ctx context.Context) error {
+				<-ctx.Done()
+				logBuf.log("worker done: %s", ctx.Err())
+				return nil
+			}),
+		)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	signalAndCheckLog(t, sigs, done, logBuf, `starting "testWorker"`,
+		`received signal: user defined signal 1`,
+		`worker done: context canceled`)
+}
+
+func TestGoReloadOnSIGHUP(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	var reloads int
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		err := runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnReload: func() error {
+				reloads++
+				return fmt.Errorf("reload %d", reloads)
+			},
+		},
+			runservicerun.WithStartFunc("testStart", func() error { return nil }),
+		)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	sigs <- syscall.SIGHUP
+	sigs <- syscall.SIGHUP
+	signalAndCheckLog(t, sigs, done, logBuf, `received signal: hangup, reloading`,
+		`reload failed with error: reload 1`,
+		`reload failed with error: reload 2`,
+		`received signal: user defined signal 1`)
+}
+
+func TestGoOnListen(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	addrs := make(chan net.Addr, 1)
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		err := runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnListen: func(name string, addr net.Addr) {
+				logBuf.log("listening %s", name)
+				addrs <- addr
+			},
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	resp, err := http.Get("http://" + (<-addrs).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusOK; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	signalAndCheckLog(t, sigs, done, logBuf, `listening 127.0.0.1:0`,
+		`starting Serve at "127.0.0.1:0"`)
+}
+
+func TestGoOnReady(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	ready := make(chan struct{})
+	var addr net.Addr
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		err := runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnListen:   func(_ string, a net.Addr) { addr = a },
+			OnReady:    func() { close(ready) },
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	<-ready
+	resp, err := http.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	signalAndCheckLog(t, sigs, done, logBuf, `starting Serve at "127.0.0.1:0"`)
+}
+
+func TestGoOnReadyNotCalledOnListenError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	logBuf := &mutextBuffer{}
+	err = runservicerun.Go(runservicerun.Options{
+		Signals:  []os.Signal{syscall.SIGUSR1},
+		LogError: logBuf.log,
+		LogInfo:  logBuf.log,
+		OnReady:  func() { t.Error("OnReady must not be called") },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithHTTPHandler(lis.Addr().String(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	if err == nil {
+		t.Fatal("expected a listen error")
+	}
+	if !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestGoContinueOnListenError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	logBuf := &mutextBuffer{}
+	ready := make(chan struct{})
+	var addr net.Addr
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan:            sigs,
+			LogError:              logBuf.log,
+			LogInfo:               logBuf.log,
+			OnListen:              func(_ string, a net.Addr) { addr = a },
+			OnReady:               func() { close(ready) },
+			ContinueOnListenError: true,
+		},
+			runservicerun.WithHTTPHandler(lis.Addr().String(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})),
+		)
+	}()
+	// OnReady gets called although the first server failed to listen
+	select {
+	case <-ready:
+	case err := <-goErr:
+		t.Fatalf("OnReady not called, Go returned: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnReady not called")
+	}
+
+	resp, err := http.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+	logs := logBuf.String()
+	if !strings.Contains(logs, "address already in use") {
+		t.Errorf("missing listen error in:\n%s", logs)
+	}
+	if strings.Contains(logs, "shutting down server "+lis.Addr().String()) {
+		t.Errorf("failed server must not be shut down:\n%s", logs)
+	}
+}
+
+func TestGoAfterListen(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	ready := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		DisableSignals: true,
+		OnListen:       func(name string, _ net.Addr) { rec.record("listen") },
+		AfterListen: func() error {
+			rec.record("after listen")
+			return nil
+		},
+		OnReady: func() {
+			rec.record("ready")
+			close(ready)
+		},
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithStartFunc("start", func() error {
+			rec.record("start")
+			return nil
+		}),
+	)
+	if _, err := r.StartAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+	if err := r.Stop(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(400 * time.Millisecond)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.order) != 4 || rec.order[0] != "listen" || rec.order[1] != "after listen" {
+		t.Errorf("AfterListen must be called after OnListen and before the start functions and OnReady: %v", rec.order)
+	}
+}
+
+func TestGoAfterListenError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	errDrop := errors.New("setuid failed")
+	var addr net.Addr
+	err := runservicerun.Go(runservicerun.Options{
+		DisableSignals: true,
+		OnListen:       func(_ string, a net.Addr) { addr = a },
+		AfterListen:    func() error { return errDrop },
+		OnReady:        func() { t.Error("OnReady must not be called") },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithStartFunc("start", func() error {
+			t.Error("start function must not run")
+			return nil
+		}),
+	)
+	if !errors.Is(err, errDrop) {
+		t.Fatalf("expected the AfterListen error, got: %v", err)
+	}
+	lis, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("listener not closed: %s", err)
+	}
+	lis.Close()
+}
+
+func TestGoBindRetry(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	time.AfterFunc(100*time.Millisecond, func() { lis.Close() })
+
+	logBuf := &mutextBuffer{}
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnReady:    func() { close(ready) },
+			BindRetry:  runservicerun.BindRetry{Attempts: 5, Backoff: 40 * time.Millisecond},
+		},
+			runservicerun.WithHTTPHandler(addr, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+	}()
+
+	select {
+	case <-ready:
+	case err := <-goErr:
+		t.Fatalf("expected the bind to be retried, got: %v\n%s", err, logBuf)
+	}
+	if !strings.Contains(logBuf.String(), "address in use, retrying in 40ms (attempt 1/5)") {
+		t.Errorf("missing retry log line in:\n%s", logBuf)
+	}
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoWithHTTPHandlerOpts(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var addr net.Addr
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a },
+	},
+		runservicerun.WithHTTPHandlerOpts("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+			func(hs *http.Server) {
+				if hs.ReadHeaderTimeout != runservicerun.DefaultReadHeaderTimeout || hs.IdleTimeout != runservicerun.DefaultIdleTimeout {
+					t.Errorf("expected default timeouts, got: %s, %s", hs.ReadHeaderTimeout, hs.IdleTimeout)
+				}
+				hs.ReadHeaderTimeout = 50 * time.Millisecond
+			},
+		),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// An incomplete request gets aborted by the overridden ReadHeaderTimeout.
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the server to close the connection, got: %v", err)
+	}
+}
+
+func TestRunnerWithHTTPServers(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var mu sync.Mutex
+	var urls []string
+	newServers := func(body string) []*http.Server {
+		var servers []*http.Server
+		for i := 0; i < 2; i++ {
+			servers = append(servers, &http.Server{
+				Addr:      "127.0.0.1:0",
+				Handler:   http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, body) }),
+				TLSConfig: &tls.Config{},
+			})
+		}
+		return servers
+	}
+	plain, secure := newServers("http"), newServers("https")
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) {
+			mu.Lock()
+			defer mu.Unlock()
+			urls = append(urls, a.String())
+		},
+	},
+		runservicerun.WithHTTPServers(plain...),
+		runservicerun.WithHTTPServersTLS("testdata/cert.crt", "testdata/key.pem", secure...),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+	for i, u := range urls {
+		scheme := "http"
+		if i >= len(plain) {
+			scheme = "https"
+		}
+		resp, err := (&http.Client{Transport: tr}).Get(scheme + "://" + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if have, want := string(b), scheme; have != want {
+			t.Errorf("\nHave: %s\nWant: %s", have, want)
+		}
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, hs := range append(plain, secure...) {
+		if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+			t.Errorf("server not shut down: %v", err)
+		}
+	}
+}
+
+func TestRunnerWithHTTPServerTLSValidation(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPServerTLS("", "", &http.Server{Addr: "127.0.0.1:0"}),
+	)
+	if err := r.Start(context.Background()); err == nil || err.Error() != "server 127.0.0.1:0: TLS requires a certificate and key file or a TLSConfig with certificates" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.crt", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr net.Addr
+	r = runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a },
+	},
+		runservicerun.WithHTTPServerTLS("", "", &http.Server{
+			Addr:      "127.0.0.1:0",
+			Handler:   http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) }),
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+func TestRunnerWithHTTPHandlerDualStack(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	errNoIPv6 := errors.New("IPv6 unavailable")
+	for _, withIPv6 := range []bool{true, false} {
+		logBuf := &mutextBuffer{}
+		var addr net.Addr
+		r := runservicerun.NewRunner(runservicerun.Options{
+			LogError: logBuf.log,
+			LogInfo:  logBuf.log,
+			OnListen: func(_ string, a net.Addr) { addr = a },
+			ListenFunc: func(network, addr string) (net.Listener, error) {
+				if network == "tcp6" && !withIPv6 {
+					return nil, errNoIPv6
+				}
+				return net.Listen(network, addr)
+			},
+		},
+			runservicerun.WithHTTPHandlerDualStack(0, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})),
+		)
+		if err := r.Start(context.Background()); err != nil {
+			if withIPv6 && strings.Contains(logBuf.String(), "failed to listen on IPv6") {
+				t.Skip("IPv6 not available")
+			}
+			t.Fatal(err)
+		}
+
+		_, port, _ := net.SplitHostPort(addr.String())
+		hosts := []string{"127.0.0.1"}
+		if withIPv6 {
+			hosts = append(hosts, "::1")
+		}
+		tr := &http.Transport{DisableKeepAlives: true}
+		for _, host := range hosts {
+			resp, err := (&http.Client{Transport: tr}).Get("http://" + net.JoinHostPort(host, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+				t.Errorf("%s\nHave: %d\nWant: %d", host, have, want)
+			}
+		}
+		if err := r.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if !withIPv6 {
+			checkLog(t, logBuf, "failed to listen on IPv6 with error: IPv6 unavailable")
+		}
+	}
+}
+
+// flakyListener fails its first Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failed atomic.Bool
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (fl *flakyListener) Accept() (net.Conn, error) {
+	if !fl.failed.Swap(true) {
+		return nil, temporaryError{}
+	}
+	return fl.Listener.Accept()
+}
+
+func TestRunnerWithHTTPHandlerDualStackTemporaryError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var addr net.Addr
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a },
+		// both address families on the loopback interface, IPv4 fails once
+		ListenFunc: func(network, _ string) (net.Listener, error) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil || network == "tcp6" {
+				return lis, err
+			}
+			return &flakyListener{Listener: lis}, nil
+		},
+	},
+		runservicerun.WithHTTPHandlerDualStack(0, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+func TestGoWithHTTPListener(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logBuf := &mutextBuffer{}
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnReady:    func() { close(ready) },
+		},
+			runservicerun.WithHTTPListener("testListener", lis, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+	}()
+
+	<-ready
+	resp, err := http.Get("http://" + lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected listener to be closed, got: %v", err)
+	}
+	if !strings.Contains(logBuf.String(), `shutting down server testListener`) {
+		t.Errorf("missing shutdown log in:\n%s", logBuf)
+	}
+}
+
+func TestGoWithPacketConn(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnReady:    func() { close(ready) },
+		},
+			runservicerun.WithPacketConn("udpEcho", pc, func(pc net.PacketConn) error {
+				buf := make([]byte, 512)
+				for {
+					n, addr, err := pc.ReadFrom(buf)
+					if err != nil {
+						return err
+					}
+					if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+						return err
+					}
+				}
+			}),
+		)
+	}()
+	<-ready
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(buf), "ping"; have != want {
+		t.Errorf("\nHave: %q\nWant: %q", have, want)
+	}
+
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// udpEchoServer implements runservicerun.PacketServer and echoes all packets.
+type udpEchoServer struct {
+	mu sync.Mutex
+	pc net.PacketConn
+}
+
+func (es *udpEchoServer) Serve(pc net.PacketConn) error {
+	es.mu.Lock()
+	es.pc = pc
+	es.mu.Unlock()
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+			return err
+		}
+	}
+}
+
+func (es *udpEchoServer) Shutdown(context.Context) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.pc.SetReadDeadline(time.Now())
+}
+
+func (es *udpEchoServer) Close() error { return nil }
+
+func TestRunnerWithPacketServer(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithPacketServer("127.0.0.1:0", &udpEchoServer{}),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := addrs["127.0.0.1:0"].String()
+
+	conn, err := net.Dial("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(buf), "ping"; have != want {
+		t.Errorf("\nHave: %q\nWant: %q", have, want)
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("packet connection not closed: %s", err)
+	}
+	pc.Close()
+}
+
+func TestGoWithHTTPUnixSocket(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	path := filepath.Join(t.TempDir(), "http.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	logBuf := &mutextBuffer{}
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnReady:    func() { close(ready) },
+		},
+			runservicerun.WithHTTPUnixSocketMode(path, 0o600, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})),
+		)
+	}()
+	<-ready
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fi.Mode().Perm(), os.FileMode(0o600); have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	tr := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected socket file to be removed, got: %v", err)
+	}
+	if !strings.Contains(logBuf.String(), "removing stale socket") {
+		t.Errorf("missing log line in:\n%s", logBuf)
+	}
+}
+
+func TestRunnerWithHTTPAbstractUnixSocket(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	path := "@runservicerun-test-" + strconv.Itoa(os.Getpid())
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPUnixSocket(path, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})),
+	)
+	_, err := r.StartAndWait(context.Background())
+	if runtime.GOOS != "linux" {
+		if !errors.Is(err, runservicerun.ErrAbstractUnixSocket) {
+			t.Fatalf("expected ErrAbstractUnixSocket, got: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Error("expected the abstract socket to be gone")
+	}
+}
+
+func TestWithSystemdSocketsErrors(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	nullHandler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	err := runservicerun.Go(runservicerun.Options{}, runservicerun.WithSystemdSockets(nullHandler))
+	if !errors.Is(err, runservicerun.ErrNoSystemdSockets) {
+		t.Errorf("expected ErrNoSystemdSockets, got: %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	err = runservicerun.Go(runservicerun.Options{}, runservicerun.WithSystemdSockets(nullHandler))
+	if !errors.Is(err, runservicerun.ErrNoSystemdSockets) || !strings.Contains(err.Error(), "does not match the current process") {
+		t.Errorf("expected a LISTEN_PID mismatch, got: %v", err)
+	}
+}
+
+func TestWithSystemdSockets(t *testing.T) {
+	lis, f := listenerFile(t)
+	addr := lis.Addr().String()
+	// the helper sets LISTEN_PID to its own pid
+	hp := startHelper(t, "systemd", []string{"LISTEN_FDS=1"}, f)
+
+	// the variables get unset once the sockets have been taken over
+	if have, want := hp.line(t), "ready "+addr; have != want {
+		hp.stop(t)
+		t.Fatalf("\nHave: %s\nWant: %s", have, want)
+	}
+	type result struct {
+		status int
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get("http://" + addr)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		results <- result{status: resp.StatusCode}
+	}()
+	if have, want := hp.line(t), "handling"; have != want {
+		hp.stop(t)
+		t.Fatalf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	// the request in flight gets drained before the helper stops
+	if have, want := hp.stop(t), "stopped"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if have, want := res.status, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+// helperEnv selects the mode of the test binary started by startHelper.
+const helperEnv = "RUNSERVICERUN_TEST_HELPER"
+
+// TestHelperProcess isn't a real test. It runs the services of the mode in a
+// child process started by startHelper, which passes the listeners as file
+// descriptors. It reports on stdout and shuts down once stdin gets closed.
+func TestHelperProcess(t *testing.T) {
+	var configs []runservicerun.Config
+	opt := runservicerun.Options{DisableSignals: true}
+	switch os.Getenv(helperEnv) {
+	case "":
+		return
+	case "inherit":
+		opt.EnableGracefulRestart = true
+		for _, addr := range strings.Split(os.Getenv(runservicerun.EnvInheritedListeners), ",") {
+			configs = append(configs, runservicerun.WithHTTPHandler(addr, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})))
+		}
+	case "signals":
+		err := runservicerun.Go(runservicerun.Options{Signals: []os.Signal{syscall.SIGTERM}},
+			runservicerun.WithStartFunc("failing", func() error { return errors.New("failed") }),
+		)
+		fmt.Println("go returned:", err)
+		time.Sleep(time.Second)
+		fmt.Println("survived SIGTERM")
+		os.Exit(0)
+	case "systemd":
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		configs = append(configs, runservicerun.WithSystemdSockets(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Println("handling")
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusTeapot)
+		})))
+	}
+
+	r := runservicerun.NewRunner(opt, configs...)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(0)
+	}
+	for _, addr := range addrs {
+		fmt.Println("ready", addr, os.Getenv(runservicerun.EnvInheritedListeners)+os.Getenv("LISTEN_FDS"))
+	}
+	_, _ = io.Copy(ioutil.Discard, os.Stdin)
+	if err := r.Stop(context.Background()); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(0)
+	}
+	fmt.Println("stopped")
+	os.Exit(0)
+}
+
+// helperProcess is a child process started by startHelper.
+type helperProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// startHelper starts TestHelperProcess in mode with the additional environment
+// variables. The files become the descriptors 3 and following.
+func startHelper(t *testing.T, mode string, env []string, files ...*os.File) *helperProcess {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	// GORACE skips the exit delay of the race detector
+	cmd.Env = append(append(os.Environ(), helperEnv+"="+mode, "GORACE=atexit_sleep_ms=0"), env...)
+	cmd.ExtraFiles = files
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return &helperProcess{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+}
+
+// line returns the next line the helper has written to stdout.
+func (hp *helperProcess) line(t *testing.T) string {
+	t.Helper()
+	l, err := hp.stdout.ReadString('\n')
+	if err != nil {
+		t.Fatalf("helper output %q: %s", l, err)
+	}
+	return strings.TrimSpace(l)
+}
+
+// stop closes stdin of the helper, which then shuts down, and returns the
+// remaining output.
+func (hp *helperProcess) stop(t *testing.T) string {
+	t.Helper()
+	_ = hp.stdin.Close()
+	rest, _ := ioutil.ReadAll(hp.stdout)
+	if err := hp.cmd.Wait(); err != nil {
+		t.Fatalf("helper failed: %s\n%s", err, rest)
+	}
+	return strings.TrimSpace(string(rest))
+}
+
+// listenerFile returns a listener bound to a free port and its file.
+func listenerFile(t *testing.T) (net.Listener, *os.File) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	f, err := lis.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return lis, f
+}
+
+func TestGracefulRestartInheritListeners(t *testing.T) {
+	lis, f := listenerFile(t)
+	addr := lis.Addr().String()
+	hp := startHelper(t, "inherit", []string{runservicerun.EnvInheritedListeners + "=" + addr}, f)
+
+	// binding the address again fails, so the helper must use the inherited
+	// listener; the variable gets unset to not pass it on
+	if have, want := hp.line(t), "ready "+addr; have != want {
+		hp.stop(t)
+		t.Fatalf("\nHave: %s\nWant: %s", have, want)
+	}
+	resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if have, want := hp.stop(t), "stopped"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestGracefulRestartMalformedListeners(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "not-a-socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	hp := startHelper(t, "inherit", []string{runservicerun.EnvInheritedListeners + "=127.0.0.1:0"}, file)
+	if have, want := hp.line(t), "error: inherited listener 127.0.0.1:0 fd 3: "; !strings.HasPrefix(have, want) {
+		t.Errorf("\nHave: %s\nWant: %s...", have, want)
+	}
+	hp.stop(t)
+}
+
+type orderRecorder struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (or *orderRecorder) record(name string) {
+	or.mu.Lock()
+	or.order = append(or.order, name)
+	or.mu.Unlock()
+}
+
+type recordCloser struct {
+	name string
+	rec  *orderRecorder
+}
+
+func (rc recordCloser) Close() error {
+	time.Sleep(10 * time.Millisecond)
+	rc.rec.record(rc.name)
+	return nil
+}
+
+// recordServer implements runservicerun.Server and records its shutdown.
+type recordServer struct {
+	recordCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (rs *recordServer) Serve(lis net.Listener) error {
+	<-rs.done
+	return lis.Close()
+}
+
+func (rs *recordServer) Shutdown(context.Context) error {
+	rs.once.Do(func() {
+		rs.recordCloser.Close()
+		close(rs.done)
+	})
+	return nil
+}
+
+func (rs *recordServer) Close() error {
+	return rs.Shutdown(context.Background())
+}
+
+type closerFunc func() error
+
+func (cf closerFunc) Close() error {
+	return cf()
+}
+
+func TestGoWithPreStart(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var or orderRecorder
+	errMigrate := errors.New("migration failed")
+	err := runservicerun.Go(runservicerun.Options{
+		Signals:  []os.Signal{syscall.SIGUSR1},
+		OnListen: func(string, net.Addr) { or.record("listen") },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithCloserAfter("closer", recordCloser{name: "closer", rec: &or}),
+		runservicerun.WithPreStart("validate", func(context.Context) error {
+			or.record("validate")
+			return nil
+		}),
+		runservicerun.WithPreStart("migrate", func(context.Context) error {
+			or.record("migrate")
+			return errMigrate
+		}),
+		runservicerun.WithPreStart("never", func(context.Context) error {
+			or.record("never")
+			return nil
+		}),
+	)
+	if !errors.Is(err, errMigrate) {
+		t.Fatalf("expected errMigrate, got: %v", err)
+	}
+	if have, want := strings.Join(or.order, ","), "validate,migrate"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestGoShutdownOrder(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	rec := &orderRecorder{}
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnReady:    func() { close(ready) },
+		},
+			runservicerun.WithCloserAfter("after1", recordCloser{name: "after1", rec: rec}),
+			runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "server1", rec: rec}, done: make(chan struct{})}),
+			runservicerun.WithCloserBefore("before1", recordCloser{name: "before1", rec: rec}),
+			runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "server2", rec: rec}, done: make(chan struct{})}),
+			runservicerun.WithCloserBefore("before2", recordCloser{name: "before2", rec: rec}),
+			runservicerun.WithCloserAfter("after2", recordCloser{name: "after2", rec: rec}),
+			runservicerun.WithCloserAfterConcurrent("concurrent1", recordCloser{name: "concurrent1", rec: rec}),
+			runservicerun.WithCloserAfterConcurrent("concurrent2", closeErr{err: errCloseAfter}),
+			runservicerun.WithCloserAfterConcurrent("concurrent3", closerFunc(func() error { panic("closer panicked") })),
+			runservicerun.WithCloserAfterConcurrent("concurrent4", recordCloser{name: "concurrent4", rec: rec}),
+		)
+	}()
+
+	<-ready
+	sigs <- syscall.SIGUSR1
+	err := <-goErr
+	if have, want := fmt.Sprint(err), "service \"concurrent2\": error close after\nservice \"concurrent3\" panicked: closer panicked"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.order) != 8 {
+		t.Fatalf("unexpected order: %v", rec.order)
+	}
+	// servers and concurrent closers run concurrently, so their order is not
+	// defined
+	sort.Strings(rec.order[2:4])
+	sort.Strings(rec.order[6:8])
+	if have, want := strings.Join(rec.order, ","), "before1,before2,server1,server2,after1,after2,concurrent1,concurrent4"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerShutdownOrder(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	stopped := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ShutdownOrder: [][]runservicerun.ShutdownStep{
+			{runservicerun.StepClosersBefore},
+			{runservicerun.StepStopFuncs},
+			{runservicerun.StepServers},
+			{runservicerun.StepClosersAfter, runservicerun.StepClosersAfterConcurrent},
+		},
+	},
+		runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "server", rec: rec}, done: make(chan struct{})}),
+		runservicerun.WithStartStopFunc("worker", func() error {
+			<-stopped
+			return nil
+		}, func(context.Context) error {
+			rec.record("worker")
+			close(stopped)
+			return nil
+		}),
+		runservicerun.WithCloserBefore("before", recordCloser{name: "before", rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "before,worker,server"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+type consumer struct {
+	rec     *orderRecorder
+	stopErr error
+}
+
+func (c consumer) Start(ctx context.Context) error {
+	<-ctx.Done()
+	c.rec.record("start returned")
+	return ctx.Err()
+}
+
+func (c consumer) Stop(context.Context) error {
+	c.rec.record("drained")
+	return c.stopErr
+}
+
+func TestRunnerWithService(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	errDrain := errors.New("drain failed")
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithService("consumer", consumer{rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	if have, want := strings.Join(rec.order, ","), "drained,start returned"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	rec.mu.Unlock()
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithService("consumer", consumer{rec: rec, stopErr: errDrain}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err := r.Stop(context.Background())
+	var se *runservicerun.ServiceError
+	if !errors.As(err, &se) || se.Name != "consumer" || se.Phase != runservicerun.PhaseStopFuncs || !errors.Is(err, errDrain) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunnerShutdownSequence(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithCloserBefore("before", recordCloser{name: "before", rec: rec}),
+		runservicerun.WithShutdownSequence(
+			runservicerun.WithCloserAfter("db", recordCloser{name: "db", rec: rec}),
+			runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "internal", rec: rec}, done: make(chan struct{})}),
+			runservicerun.WithCloserBefore("buffer", recordCloser{name: "buffer", rec: rec}),
+			runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "public", rec: rec}, done: make(chan struct{})}),
+		),
+		runservicerun.WithCloserAfter("after", recordCloser{name: "after", rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "before,public,buffer,internal,db,after"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+// waitingServer shuts down once wait gets closed.
+type waitingServer struct {
+	wait, done chan struct{}
+}
+
+func (ws waitingServer) Serve(lis net.Listener) error {
+	<-ws.done
+	return lis.Close()
+}
+
+func (ws waitingServer) Shutdown(ctx context.Context) error {
+	defer close(ws.done)
+	select {
+	case <-ws.wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ws waitingServer) Close() error { return nil }
+
+func TestRunnerWithCloserDuring(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	deregistered := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{ShutdownTimeout: time.Second},
+		runservicerun.WithServer("127.0.0.1:0", waitingServer{wait: deregistered, done: make(chan struct{})}),
+		runservicerun.WithCloserDuring("deregister", closerFunc(func() error {
+			rec.record("deregister")
+			close(deregistered)
+			return nil
+		})),
+		runservicerun.WithCloserDuring("failing", closeErr{err: errCloseAfter}),
+		runservicerun.WithCloserAfter("after", recordCloser{name: "after", rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); !errors.Is(err, errCloseAfter) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "deregister,after"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerWithDependsOn(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithDependsOn("api", runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "api", rec: rec}, done: make(chan struct{})}), "cache"),
+		runservicerun.WithDependsOn("db", runservicerun.WithCloserAfter("db", recordCloser{name: "db", rec: rec})),
+		runservicerun.WithDependsOn("cache", runservicerun.WithCloserBefore("cache", recordCloser{name: "cache", rec: rec}), "db"),
+		runservicerun.WithCloserAfter("after", recordCloser{name: "after", rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "api,cache,db,after"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerWithDependsOnInvalid(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	nop := runservicerun.WithCloserAfter("nop", closerFunc(func() error { return nil }))
+	for _, tc := range []struct {
+		configs []runservicerun.Config
+		want    string
+	}{
+		{
+			[]runservicerun.Config{
+				runservicerun.WithDependsOn("api", nop, "cache"),
+				runservicerun.WithDependsOn("cache", nop, "db"),
+				runservicerun.WithDependsOn("db", nop, "api"),
+			},
+			"dependency cycle: api -> cache -> db -> api",
+		},
+		{
+			[]runservicerun.Config{runservicerun.WithDependsOn("api", nop, "missing")},
+			`dependency node "api" depends on unknown node "missing"`,
+		},
+		{
+			[]runservicerun.Config{runservicerun.WithDependsOn("api", nop), runservicerun.WithDependsOn("api", nop)},
+			`dependency node "api" registered twice`,
+		},
+	} {
+		var closed atomic.Bool
+		configs := append(tc.configs, runservicerun.WithCloserBefore("before", closerFunc(func() error {
+			closed.Store(true)
+			return nil
+		})))
+		err := runservicerun.NewRunner(runservicerun.Options{}, configs...).Start(context.Background())
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("\nHave: %v\nWant: %s", err, tc.want)
+		}
+		if closed.Load() {
+			t.Error("closers must be skipped")
+		}
+	}
+}
+
+func TestRunnerConfigs(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	bundle := runservicerun.Configs(
+		runservicerun.WithCloserAfter("first", recordCloser{name: "first", rec: rec}),
+		runservicerun.Configs(
+			runservicerun.WithCloserAfter("second", recordCloser{name: "second", rec: rec}),
+		),
+	)
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		bundle,
+		runservicerun.WithCloserAfter("third", recordCloser{name: "third", rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "first,second,third"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.Configs(runservicerun.WithTicker("tick", 0, nil)),
+	)
+	if err := r.Start(context.Background()); err == nil {
+		t.Error("expected the error of the inner config")
+	}
+}
+
+func TestRunnerIfMaybe(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	newCloser := func(name string, err error) (runservicerun.Config, error) {
+		return runservicerun.WithCloserAfter(name, recordCloser{name: name, rec: rec}), err
+	}
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.If(true, runservicerun.WithCloserAfter("enabled", recordCloser{name: "enabled", rec: rec})),
+		runservicerun.If(false, runservicerun.WithCloserAfter("disabled", recordCloser{name: "disabled", rec: rec})),
+		runservicerun.Maybe(newCloser("constructed", nil)),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	if have, want := strings.Join(rec.order, ","), "enabled,constructed"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	rec.mu.Unlock()
+
+	errConstruct := errors.New("construction failed")
+	r = runservicerun.NewRunner(runservicerun.Options{}, runservicerun.Maybe(newCloser("failed", errConstruct)))
+	if err := r.Start(context.Background()); !errors.Is(err, errConstruct) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunnerShutdownLIFO(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	config := func(name string, fn func(string, io.Closer) runservicerun.Config) runservicerun.Config {
+		return fn(name, recordCloser{name: name, rec: rec})
+	}
+	r := runservicerun.NewRunner(runservicerun.Options{ShutdownLIFO: true},
+		runservicerun.WithServer("127.0.0.1:0", &recordServer{recordCloser: recordCloser{name: "server", rec: rec}, done: make(chan struct{})}),
+		config("before1", runservicerun.WithCloserBefore),
+		config("after1", runservicerun.WithCloserAfter),
+		config("before2", runservicerun.WithCloserBefore),
+		config("after2", runservicerun.WithCloserAfter),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "before2,before1,server,after2,after1"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerOnPhase(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var phases []string
+	r := runservicerun.NewRunner(runservicerun.Options{
+		PreShutdownDelay: 10 * time.Millisecond,
+		OnPhase:          func(p runservicerun.Phase) { phases = append(phases, p.String()) },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "ShutdownBegin,PreShutdownDelay,ClosersBefore,Servers,StopFuncs,ClosersAfter,ClosersAfterConcurrent,Complete"
+	if have := strings.Join(phases, ","); have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerInvalidShutdownOrder(t *testing.T) {
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ShutdownOrder: [][]runservicerun.ShutdownStep{{runservicerun.StepServers, runservicerun.StepServers}},
+	})
+	if err := r.Start(context.Background()); err == nil || err.Error() != "shutdown step Servers listed twice" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type ctxKey struct{}
+
+func TestRunnerBaseContext(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	handling := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		Context: context.WithValue(context.Background(), ctxKey{}, "traceID"),
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(handling)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+				t.Error("request context not canceled on shutdown")
+			}
+			fmt.Fprint(w, r.Context().Value(ctxKey{}))
+		})),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + addrs["127.0.0.1:0"].String())
+		if err != nil {
+			t.Error(err)
+			body <- ""
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-handling
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := <-body, "traceID"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerCallbackContexts(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	observe := func(name string, ctx context.Context) {
+		if ctx.Value(ctxKey{}) != "traceID" {
+			t.Errorf("%s: context without value", name)
+		}
+		select {
+		case <-ctx.Done():
+			rec.record(name)
+		case <-time.After(time.Second):
+			t.Errorf("%s: context not canceled", name)
+		}
+	}
+	stopped := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		Context:         context.WithValue(context.Background(), ctxKey{}, "traceID"),
+		ShutdownTimeout: 20 * time.Millisecond,
+	},
+		runservicerun.WithPreStart("preStart", func(ctx context.Context) error {
+			if ctx.Value(ctxKey{}) != "traceID" {
+				t.Error("preStart: context without value")
+			}
+			return nil
+		}),
+		runservicerun.WithStartFuncContext("start", func(ctx context.Context) error {
+			observe("start", ctx)
+			return nil
+		}),
+		runservicerun.WithStartFuncPriority("prio", 1, func(ctx context.Context, ready func()) error {
+			ready()
+			observe("prio", ctx)
+			return nil
+		}),
+		runservicerun.WithStartStopFunc("startStop", func() error {
+			<-stopped
+			return nil
+		}, func(ctx context.Context) error {
+			defer close(stopped)
+			observe("stop", ctx)
+			return nil
+		}),
+		runservicerun.WithCloserBeforeContext("before", func(ctx context.Context) error {
+			observe("before", ctx)
+			return nil
+		}),
+		runservicerun.WithCloserAfterContext("after", func(ctx context.Context) error {
+			observe("after", ctx)
+			return nil
+		}),
+	)
+	ctx := context.WithValue(context.Background(), ctxKey{}, "traceID")
+	if err := r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	sort.Strings(rec.order)
+	if have, want := strings.Join(rec.order, ","), "after,before,prio,start,stop"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerWithHTTPHandlerTimeout(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	release := make(chan struct{})
+	defer close(release)
+	handling := make(chan struct{}, 2)
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		handling <- struct{}{}
+		<-release
+	})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError:        logBuf.log,
+		LogInfo:         logBuf.log,
+		ShutdownTimeout: 10 * time.Second,
+	},
+		runservicerun.WithHTTPHandlerTimeout("127.0.0.1:0", handler, 50*time.Millisecond),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		resp, err := http.Get("http://" + addrs["127.0.0.1:0"].String())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-handling
+
+	begin := time.Now()
+	if err := r.Stop(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+	checkLog(t, logBuf, "failed to shutdown within 50ms, closing it")
+}
+
+func TestRunnerStartAndWait(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var ready atomic.Bool
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithStartFuncReady("worker", func(readyFn func()) error {
+			time.Sleep(20 * time.Millisecond)
+			ready.Store(true)
+			readyFn()
+			return nil
+		}),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ready.Load() {
+		t.Error("StartAndWait returned before the services were ready")
+	}
+	if len(addrs) != 1 || addrs["127.0.0.1:0"] == nil || strings.HasSuffix(addrs["127.0.0.1:0"].String(), ":0") {
+		t.Errorf("unexpected addresses: %v", addrs)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithStartFuncReady("worker", func(func()) error { return errors.New("failed") }),
+	)
+	if _, err := r.StartAndWait(context.Background()); err == nil || err.Error() != `service "worker": failed` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func ExampleWithHTTPHandler_longLived() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				// the shutdown began, a WebSocket would send a close frame here
+				return
+			case <-ticker.C:
+				fmt.Fprintln(conn, "ping")
+			}
+		}
+	})
+	_ = runservicerun.Go(runservicerun.Options{ShutdownTimeout: 10 * time.Second},
+		runservicerun.WithHTTPHandler(":7878", handler),
+	)
+}
+
+func TestRunnerHijackedConnection(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	handlerDone := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{ShutdownTimeout: 10 * time.Second},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(handlerDone)
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\n\r\n")
+			<-r.Context().Done()
+		})),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addrs["127.0.0.1:0"].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := time.Now()
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handlerDone:
+	case <-time.After(time.Second):
+		t.Fatal("handler of the hijacked connection did not end")
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+}
+
+func TestRunnerPreShutdownDelay(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	var addr net.Addr
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError:         logBuf.log,
+		LogInfo:          logBuf.log,
+		OnListen:         func(_ string, a net.Addr) { addr = a },
+		PreShutdownDelay: 200 * time.Millisecond,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	get := func() *http.Response {
+		resp, err := (&http.Client{Transport: tr}).Get("http://" + addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if get().Close {
+		t.Error("unexpected Connection: close before the shutdown")
+	}
+
+	stopErr := make(chan error)
+	go func() { stopErr <- r.Stop(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// still serving during the delay but closing keep-alive connections
+	resp := get()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if !resp.Close {
+		t.Error("expected Connection: close during the shutdown")
+	}
+
+	if err := <-stopErr; err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"pre-shutdown delay of 200ms started", "pre-shutdown delay ended"} {
+		if !strings.Contains(logBuf.String(), l) {
+			t.Errorf("%s\n\ndoes not contain: %s", logBuf, l)
+		}
+	}
+}
+
+func TestRunnerDraining(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	var addr net.Addr
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	var conns int
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError: logBuf.log,
+		LogInfo:  logBuf.log,
+		OnListen: func(_ string, a net.Addr) { addr = a },
+		OnEvent: func(evt runservicerun.Event) {
+			if evt.Type == runservicerun.EventDraining {
+				conns = evt.Connections
+				releaseOnce.Do(func() { close(release) })
+			}
+		},
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(handling)
+			<-release
+		})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tr := &http.Transport{DisableKeepAlives: true}
+		resp, err := (&http.Client{Transport: tr}).Get("http://" + addr.String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	<-handling
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if have, want := conns, 1; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	checkLog(t, logBuf, "draining for 0s, 1 connections remaining")
+}
+
+func TestRunnerSlowShutdownThreshold(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	handling := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError:              logBuf.log,
+		LogInfo:               logBuf.log,
+		SlowShutdownThreshold: 50 * time.Millisecond,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			close(handling)
+			time.Sleep(150 * time.Millisecond)
+		})),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		if resp, err := client.Get("http://" + addrs["127.0.0.1:0"].String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-handling
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	checkLog(t, logBuf, "server 127.0.0.1:0 still shutting down after 50ms, 1 connections remaining")
+}
+
+type tlsServer struct {
+	*http.Server
+}
+
+func (s tlsServer) Serve(lis net.Listener) error {
+	return s.Server.Serve(tls.NewListener(lis, s.TLSConfig))
+}
+
+func TestRunnerWithMuxListener(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.crt", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, body) })
+	}
+	var addr net.Addr
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a },
+	},
+		runservicerun.WithMuxListener("127.0.0.1:0",
+			runservicerun.MuxRoute{Name: "https", Match: runservicerun.MatchTLS, Server: tlsServer{&http.Server{
+				Handler:   handler("https"),
+				TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			}}},
+			runservicerun.MuxRoute{Name: "http", Match: runservicerun.MatchHTTP1, Server: &http.Server{Handler: handler("http")}},
+		),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+	for _, scheme := range []string{"http", "https"} {
+		resp, err := (&http.Client{Transport: tr}).Get(scheme + "://" + addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if have, want := string(b), scheme; have != want {
+			t.Errorf("\nHave: %s\nWant: %s", have, want)
+		}
+	}
+
+	// matching no route closes the connection
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(c, "HELLO\r\n")
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	c.Close()
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerShutdownJitter(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError:       logBuf.log,
+		LogInfo:        logBuf.log,
+		ShutdownJitter: 50 * time.Millisecond,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("shutdown took %s", d)
+	}
+	checkLog(t, logBuf, "shutdown jitter of ")
+}
+
+// fcgiRequest returns the records of a minimal FastCGI GET request. With
+// keepConn the web server asks to keep the connection open afterwards.
+func fcgiRequest(keepConn bool) []byte {
+	record := func(typ byte, content []byte) []byte {
+		return append([]byte{1, typ, 0, 1, byte(len(content) >> 8), byte(len(content)), 0, 0}, content...)
+	}
+	var params []byte
+	for _, kv := range [][2]string{{"REQUEST_METHOD", "GET"}, {"SERVER_PROTOCOL", "HTTP/1.1"}, {"REQUEST_URI", "/"}} {
+		params = append(append(append(params, byte(len(kv[0])), byte(len(kv[1]))), kv[0]...), kv[1]...)
+	}
+	var flags byte
+	if keepConn {
+		flags = 1
+	}
+	var req []byte
+	req = append(req, record(1, []byte{0, 1, flags, 0, 0, 0, 0, 0})...) // begin request, responder role
+	req = append(req, record(4, params)...)
+	req = append(req, record(4, nil)...)
+	req = append(req, record(5, nil)...)
+	return req
+}
+
+// fcgiGet sends a minimal FastCGI GET request and returns the raw response
+// records.
+func fcgiGet(t *testing.T, network, addr string) string {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(fcgiRequest(false)); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := ioutil.ReadAll(c)
+	return string(resp)
+}
+
+func TestRunnerWithFastCGI(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sock := filepath.Join(t.TempDir(), "fcgi.sock")
+	var addr net.Addr
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "hello fastcgi") })
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(name string, a net.Addr) {
+			if name != sock {
+				addr = a
+			}
+		},
+	},
+		runservicerun.WithFastCGI("127.0.0.1:0", handler),
+		runservicerun.WithFastCGIUnixSocket(sock, handler),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for network, a := range map[string]string{"tcp": addr.String(), "unix": sock} {
+		if resp := fcgiGet(t, network, a); !strings.Contains(resp, "hello fastcgi") {
+			t.Errorf("%s: unexpected response %q", network, resp)
+		}
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed: %v", err)
+	}
+}
+
+func TestRunnerWithFastCGIKeepConn(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var addr net.Addr
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a },
+	},
+		runservicerun.WithFastCGI("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "hello fastcgi") })),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(fcgiRequest(true)); err != nil {
+		t.Fatal(err)
+	}
+	// read the records up to the end request record, the connection stays open
+	for {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, int(hdr[4])<<8|int(hdr[5])+int(hdr[6]))); err != nil {
+			t.Fatal(err)
+		}
+		if hdr[1] == 3 {
+			break
+		}
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the kept connection to be closed, got: %v", err)
+	}
+}
+
+func TestRunnerDrainMiddleware(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{PreShutdownDelay: 100 * time.Millisecond},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", runservicerun.DrainMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			handling <- struct{}{}
+			<-release
+		}))),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + addrs["127.0.0.1:0"].String()
+	tr := &http.Transport{DisableKeepAlives: true}
+
+	inFlight := make(chan int)
+	go func() {
+		resp, err := (&http.Client{Transport: tr}).Get(url)
+		if err != nil {
+			t.Error(err)
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-handling
+
+	stopErr := make(chan error)
+	go func() { stopErr <- r.Stop(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	resp, err := (&http.Client{Transport: tr}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("unexpected response during the shutdown: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	close(release)
+	if have, want := <-inFlight, http.StatusOK; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if err := <-stopErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerWithHealthEndpoint(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var addr net.Addr
+	ready := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen:         func(_ string, a net.Addr) { addr = a },
+		OnReady:          func() { close(ready) },
+		PreShutdownDelay: 200 * time.Millisecond,
+	},
+		runservicerun.WithHealthEndpoint("127.0.0.1:0", "/healthz"),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	status := func() int {
+		resp, err := client.Get("http://" + addr.String() + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if have, want := status(), http.StatusOK; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+
+	stopErr := make(chan error)
+	go func() { stopErr <- r.Stop(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	if have, want := status(), http.StatusServiceUnavailable; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+	if err := <-stopErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerWithHTTPHandlerFunc(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	hello := func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("hello")) }
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	}}
+	for _, tc := range []struct {
+		cfg    runservicerun.Config
+		scheme string
+	}{
+		{runservicerun.WithHTTPHandlerFunc("127.0.0.1:0", hello), "http"},
+		{runservicerun.WithHTTPHandlerFuncTLS("127.0.0.1:0", "testdata/cert.crt", "testdata/key.pem", nil, hello), "https"},
+	} {
+		r := runservicerun.NewRunner(runservicerun.Options{}, tc.cfg)
+		addrs, err := r.StartAndWait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(tc.scheme + "://" + addrs["127.0.0.1:0"].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if have, want := string(body), "hello"; have != want {
+			t.Errorf("%s\nHave: %s\nWant: %s", tc.scheme, have, want)
+		}
+		if err := r.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunnerWithHTTPHandlerMiddleware(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var order []string
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandlerMiddleware("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			order = append(order, "handler")
+		}), mw("outer"), mw("inner")),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addrs["127.0.0.1:0"].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(order, ","), "outer,inner,handler"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerWithHTTPHandlerTLSConfig(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.crt", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served atomic.Bool
+	tlsConfig := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		served.Store(true)
+		return &cert, nil
+	}}
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandlerTLSConfig("127.0.0.1:0", tlsConfig, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("hello"))
+		})),
+	)
+	addrs, err := r.StartAndWait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + addrs["127.0.0.1:0"].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !served.Load() {
+		t.Error("GetCertificate not called")
+	}
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandlerTLSConfig("127.0.0.1:0", &tls.Config{}, http.NotFoundHandler()),
+	)
+	if err := r.Start(context.Background()); err == nil {
+		t.Error("expected an error for a TLSConfig without certificates")
+	}
+}
+
+func TestRunnerWithDebugServer(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, tc := range []struct {
+		cfg    runservicerun.Config
+		prefix string
+	}{
+		{runservicerun.WithDebugServer("127.0.0.1:0"), ""},
+		{runservicerun.WithDebugServerPrefix("127.0.0.1:0", "/admin/"), "/admin"},
+	} {
+		r := runservicerun.NewRunner(runservicerun.Options{}, tc.cfg)
+		addrs, err := r.StartAndWait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/vars"} {
+			url := "http://" + addrs["127.0.0.1:0"].String() + tc.prefix + path
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if have, want := resp.StatusCode, http.StatusOK; have != want {
+				t.Errorf("%s\nHave: %d\nWant: %d", url, have, want)
+			}
+		}
+		if err := r.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunnerWithStaticFiles(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, tc := range []struct {
+		cfg        runservicerun.Config
+		wantApp    int
+		wantAppDoc string
+	}{
+		{runservicerun.WithStaticFiles("127.0.0.1:0", "testdata/static"), http.StatusNotFound, "404 page not found"},
+		{runservicerun.WithStaticFilesSPA("127.0.0.1:0", "testdata/static"), http.StatusOK, "<title>index</title>"},
+	} {
+		r := runservicerun.NewRunner(runservicerun.Options{}, tc.cfg)
+		addrs, err := r.StartAndWait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := addrs["127.0.0.1:0"].String()
+		get := func(path string) (int, string) {
+			resp, err := client.Get("http://" + addr + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+		if code, body := get("/style.css"); code != http.StatusOK || !strings.Contains(body, "margin") {
+			t.Errorf("/style.css: %d %q", code, body)
+		}
+		if code, body := get("/app/settings"); code != tc.wantApp || !strings.Contains(body, tc.wantAppDoc) {
+			t.Errorf("/app/settings: %d %q", code, body)
+		}
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, "GET /../../go.mod HTTP/1.0\r\n\r\n")
+		raw, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if strings.Contains(string(raw), "module github.com/SchumacherFM/runservicerun") {
+			t.Errorf("served a file outside of the directory:\n%s", raw)
+		}
+
+		if err := r.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGoStartTimeout(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	err := runservicerun.Go(runservicerun.Options{
+		Signals:      []os.Signal{syscall.SIGUSR1},
+		LogError:     logBuf.log,
+		LogInfo:      logBuf.log,
+		StartTimeout: 50 * time.Millisecond,
+		OnListen: func(string, net.Addr) {
+			time.Sleep(150 * time.Millisecond) // simulates a hanging start
+		},
+		OnReady: func() { t.Error("OnReady must not be called") },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithStartFunc("testStart", func() error { return nil }),
+	)
+	if !errors.Is(err, runservicerun.ErrStartTimeout) {
+		t.Fatalf("expected ErrStartTimeout, got: %v", err)
+	}
+	if have, want := err.Error(), `services ["127.0.0.1:0" "testStart"] not ready within 50ms: start timeout exceeded`; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerMaxShutdownDuration(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+	release := make(chan struct{})
+	defer close(release)
+
+	logBuf := &mutextBuffer{}
+	var closedAfter atomic.Bool
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError:            logBuf.log,
+		LogInfo:             logBuf.log,
+		MaxShutdownDuration: 100 * time.Millisecond,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithCloserBefore("hanging", closerFunc(func() error {
+			<-release
+			return nil
+		})),
+		runservicerun.WithCloserAfter("testCloserA", closerFunc(func() error {
+			closedAfter.Store(true)
+			return nil
+		})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := r.Stop(context.Background())
+	if !errors.Is(err, runservicerun.ErrMaxShutdownDuration) {
+		t.Fatalf("expected ErrMaxShutdownDuration, got: %v", err)
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("shutdown took %s", d)
+	}
+	if closedAfter.Load() {
+		t.Error("closer after must be skipped")
+	}
+	checkLog(t, logBuf,
+		"shutdown exceeded 100ms in phase ClosersBefore, aborting",
+		"skipping shutdown step ClosersAfter",
+	)
+}
+
+func TestGoMaxShutdownDurationAbandons(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+	release := make(chan struct{})
+	defer close(release)
+
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGTERM
+	start := time.Now()
+	err := runservicerun.Go(runservicerun.Options{
+		SignalChan:          sigs,
+		MaxShutdownDuration: 100 * time.Millisecond,
+	},
+		runservicerun.WithStartStopFunc("stubborn", func() error {
+			<-release
+			return nil
+		}, func(context.Context) error {
+			<-release
+			return nil
+		}),
+	)
+	if !errors.Is(err, runservicerun.ErrMaxShutdownDuration) {
+		t.Fatalf("expected ErrMaxShutdownDuration, got: %v", err)
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("Go took %s", d)
+	}
+}
+
+func TestGoFailingServiceStopsSignals(t *testing.T) {
+	// Without any registration left SIGTERM terminates the helper, a stale
+	// registration of Go would swallow it.
+	hp := startHelper(t, "signals", nil)
+	if line := hp.line(t); !strings.HasPrefix(line, "go returned: ") {
+		t.Fatalf("unexpected helper output %q", line)
+	}
+	if err := hp.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(hp.stdout)
+	err := hp.cmd.Wait()
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("expected the helper to be killed by the signal, got: %v\n%s", err, out)
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() || ws.Signal() != syscall.SIGTERM {
+		t.Errorf("expected the helper to be killed by SIGTERM, got: %s\n%s", ee, out)
+	}
+}
+
+func TestGoForceSignals(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+	release := make(chan struct{})
+	defer close(release)
+
+	logBuf := &mutextBuffer{}
+	sigs := make(chan os.Signal)
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan:       sigs,
+			GracefulSignals:  []os.Signal{syscall.SIGTERM},
+			ForceSignals:     []os.Signal{syscall.SIGQUIT},
+			PreShutdownDelay: 5 * time.Second,
+			LogError:         logBuf.log,
+			LogInfo:          logBuf.log,
+		},
+			runservicerun.WithStartStopFunc("stubborn", func() error {
+				<-release
+				return nil
+			}, func(context.Context) error {
+				<-release
+				return nil
+			}),
+		)
+	}()
+
+	sigs <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-goErr:
+		t.Fatalf("Go returned during the drain: %v", err)
+	default:
+	}
+	sigs <- syscall.SIGQUIT
+
+	select {
+	case err := <-goErr:
+		if !errors.Is(err, runservicerun.ErrShutdownForced) {
+			t.Errorf("expected ErrShutdownForced, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("force signal did not end Go")
+	}
+	checkLog(t, logBuf,
+		"received signal: terminated",
+		"received force signal: quit, closing all services",
+		"shutdown forced, abandoning the services still running",
+	)
+}
+
+func TestRunnerStartupAndShutdownErrors(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandler(busy.Addr().String(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
+	)
+	err = r.Start(context.Background())
+	if !errors.Is(err, runservicerun.ErrStartup) || !errors.Is(err, runservicerun.ErrShutdown) {
+		t.Fatalf("expected startup and shutdown errors, got: %v", err)
+	}
+	if !errors.Is(err, errCloseAfter) {
+		t.Errorf("missing the closer error in: %v", err)
+	}
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Stop(context.Background())
+	if errors.Is(err, runservicerun.ErrStartup) || !errors.Is(err, runservicerun.ErrShutdown) {
+		t.Errorf("expected only a shutdown error, got: %v", err)
+	}
+}
+
+func TestShutdownReason(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	reasons := make(chan runservicerun.Reason, 1)
+	recordReason := runservicerun.WithCloserAfterContext("reason", func(ctx context.Context) error {
+		reason, ok := runservicerun.ShutdownReason(ctx)
+		if !ok {
+			t.Error("missing shutdown reason")
+		}
+		reasons <- reason
+		return nil
+	})
+	check := func(want runservicerun.Reason) {
+		t.Helper()
+		if have := <-reasons; have != want {
+			t.Errorf("\nHave: %s\nWant: %s", have, want)
+		}
+	}
+
+	if _, ok := runservicerun.ShutdownReason(context.Background()); ok {
+		t.Error("unexpected shutdown reason")
+	}
+	r := runservicerun.NewRunner(runservicerun.Options{}, recordReason)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(runservicerun.ReasonStop)
+
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGTERM
+	if err := runservicerun.Go(runservicerun.Options{SignalChan: sigs}, recordReason); err != nil {
+		t.Fatal(err)
+	}
+	check(runservicerun.ReasonSignal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = runservicerun.NewRunner(runservicerun.Options{Context: ctx}, recordReason)
+	if err := r.Start(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	r = runservicerun.NewRunner(runservicerun.Options{Context: ctx}, recordReason)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	_ = r.Wait()
+	check(runservicerun.ReasonContextCanceled)
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithStartFunc("failing", func() error { return errors.New("failed") }),
+		recordReason,
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Wait()
+	check(runservicerun.ReasonServiceFailed)
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithStartFuncPriority("prio", 1, func(ctx context.Context, ready func()) error {
+			ready()
+			<-ctx.Done()
+			reason, ok := runservicerun.ShutdownReason(ctx)
+			if !ok {
+				t.Error("missing shutdown reason in priority start func")
+			}
+			reasons <- reason
+			return nil
+		}),
+	)
+	if _, err := r.StartAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(runservicerun.ReasonStop)
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("failed"), 1},
+		{runservicerun.ErrMaxShutdownDuration, runservicerun.ExitCodeShutdownTimeout},
+		{fmt.Errorf("server: %w", context.DeadlineExceeded), 1},
+		{&runservicerun.ShutdownTimeoutError{Timeout: time.Second}, runservicerun.ExitCodeShutdownTimeout},
+		{errors.Join(errors.New("failed"), &runservicerun.ShutdownTimeoutError{Timeout: time.Second}), runservicerun.ExitCodeShutdownTimeout},
+		{&runservicerun.SignalError{Signal: syscall.SIGTERM}, 143},
+		{errors.Join(errors.New("failed"), &runservicerun.SignalError{Signal: syscall.SIGINT}), 130},
+	} {
+		if have := runservicerun.ExitCode(tc.err); have != tc.want {
+			t.Errorf("%v\nHave: %d\nWant: %d", tc.err, have, tc.want)
+		}
+	}
+}
+
+func TestGoReturnSignalError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGTERM
+	err := runservicerun.Go(runservicerun.Options{
+		SignalChan:        sigs,
+		ReturnSignalError: true,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	var se *runservicerun.SignalError
+	if !errors.As(err, &se) || se.Signal != syscall.SIGTERM {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := runservicerun.ExitCode(err), 143; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+func TestGoResult(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rep, err := runservicerun.GoResult(runservicerun.Options{
+		Signals: []os.Signal{syscall.SIGUSR1},
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithStartFunc("testStart", func() error {
+			time.Sleep(50 * time.Millisecond)
+			return errors.New("startFn failed")
+		}),
+		runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for name, want := range map[string]runservicerun.ServiceReport{
+		"127.0.0.1:0": {Started: true, Stopped: true},
+		"testStart":   {Started: true, Err: errors.New("startFn failed")},
+		"testCloserA": {Err: errCloseAfter},
+	} {
+		have := rep.Services[name]
+		if have.Started != want.Started || have.Stopped != want.Stopped || fmt.Sprint(have.Err) != fmt.Sprint(want.Err) {
+			t.Errorf("%s\nHave: %+v\nWant: %+v", name, have, want)
+		}
+	}
+}
+
+func TestRunnerIgnoreErrors(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	r := runservicerun.NewRunner(runservicerun.Options{
+		IgnoreErrors: []error{context.Canceled, errCloseAfter},
+	},
+		runservicerun.WithStartFuncContext("worker", func(ctx context.Context) error {
+			<-ctx.Done()
+			return fmt.Errorf("worker stopped: %w", ctx.Err())
+		}),
+		runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sr := r.Report().Services["worker"]; !sr.Stopped || sr.Err != nil {
+		t.Errorf("unexpected report: %+v", sr)
+	}
+}
+
+func TestRunnerCloserEOF(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	errWrappedEOF := fmt.Errorf("reading state: %w", io.EOF)
+	for _, eofIsError := range []bool{false, true} {
+		r := runservicerun.NewRunner(runservicerun.Options{EOFIsError: eofIsError},
+			runservicerun.WithStartFunc("start", func() error { return errWrappedEOF }),
+			runservicerun.WithCloserAfter("closer", closeErr{err: errWrappedEOF}),
+		)
+		if err := r.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		err := r.Stop(context.Background())
+		if have, want := errors.Is(err, io.EOF), eofIsError; have != want {
+			t.Errorf("EOFIsError %t: unexpected error: %v", eofIsError, err)
+		}
+		if have, want := r.Report().Services["closer"].Err != nil, eofIsError; have != want {
+			t.Errorf("EOFIsError %t: unexpected closer report: %+v", eofIsError, r.Report().Services["closer"])
+		}
+	}
+}
+
+func TestRunnerWithFinalizer(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	rec := &orderRecorder{}
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithStartFunc("testStart", func() error {
+			return errors.New("startFn failed")
+		}),
+		runservicerun.WithCloserAfter("closer", recordCloser{name: "closer", rec: rec}),
+		runservicerun.WithFinalizer("first", func() error {
+			rec.record("first")
+			panic("first finalizer")
+		}),
+		runservicerun.WithFinalizer("second", func() error {
+			rec.record("second")
+			return nil
+		}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err := r.Wait()
+	if err == nil || !strings.Contains(err.Error(), "startFn failed") || !strings.Contains(err.Error(), "first finalizer") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := r.Stop(context.Background()); err == nil {
+		t.Error("expected the error of the run")
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "closer,first,second"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerWithTicker(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	var runs atomic.Int32
+	twice := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError: logBuf.log,
+		LogInfo:  logBuf.log,
+	},
+		runservicerun.WithTicker("tick", 10*time.Millisecond, func(context.Context) error {
+			if runs.Add(1) == 2 {
+				close(twice)
+			}
+			return nil
+		}),
+		runservicerun.WithStartFuncContext("worker", func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-twice
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := runs.Load()
+	time.Sleep(30 * time.Millisecond)
+	if have := runs.Load(); have != stopped {
+		t.Errorf("ticker ran %d times after the shutdown", have-stopped)
+	}
+	checkLog(t, logBuf, `ticker "tick" stopped`)
+	if strings.Contains(logBuf.String(), `"worker" stopped`) {
+		t.Errorf("only tickers log when they stopped:\n%s", logBuf)
+	}
+
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithTicker("tick", 0, func(context.Context) error { return nil }),
+	)
+	if err := r.Start(context.Background()); err == nil || err.Error() != `ticker "tick": interval must be positive, got 0s` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type fakeConnector struct{ err error }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return fakeConn{}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func TestRunnerWithDatabase(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	db := sql.OpenDB(fakeConnector{})
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithDatabase("db", db, true),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("expected a closed database, have: %v", err)
+	}
+
+	// a failing pre-start skips the closers
+	unreachable := sql.OpenDB(fakeConnector{err: errors.New("unreachable")})
+	defer unreachable.Close()
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithDatabase("db", unreachable, true),
+	)
+	if err := r.Start(context.Background()); err == nil || err.Error() != `service "db": unreachable` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunnerCloserTimeout(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+	block := make(chan struct{})
+	defer close(block)
+
+	logBuf := &mutextBuffer{}
+	rec := &orderRecorder{}
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError:      logBuf.log,
+		LogInfo:       logBuf.log,
+		CloserTimeout: 50 * time.Millisecond,
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithCloserAfter("blocking", closerFunc(func() error {
+			<-block
+			return nil
+		})),
+		runservicerun.WithCloserAfter("next", recordCloser{name: "next", rec: rec}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	err := r.Stop(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("shutdown took %s", d)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "next"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	checkLog(t, logBuf, `service "blocking" failed to close with error: closer did not return within 50ms`)
+}
+
+func TestRunnerWithSupervisedStartFunc(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	var runs atomic.Int32
+	running := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		LogError: logBuf.log,
+		LogInfo:  logBuf.log,
+	},
+		runservicerun.WithSupervisedStartFunc("worker", func(ctx context.Context) error {
+			if runs.Add(1) < 3 {
+				return errors.New("crashed")
+			}
+			close(running)
+			<-ctx.Done()
+			return nil
+		}, 3, time.Millisecond),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-running
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkLog(t, logBuf,
+		`service "worker" failed with error: crashed, restart 1 of 3 in 1ms`,
+		`service "worker" failed with error: crashed, restart 2 of 3 in 2ms`)
+
+	runs.Store(0)
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithSupervisedStartFunc("worker", func(context.Context) error {
+			runs.Add(1)
+			panic("crashed")
+		}, 2, time.Millisecond),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Wait(); err == nil || !strings.Contains(err.Error(), "crashed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if have, want := runs.Load(), int32(3); have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+func TestGoStartFuncPriority(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	rec := &orderRecorder{}
+	worker := func(name string, warmup time.Duration) func(context.Context, func()) error {
+		return func(ctx context.Context, ready func()) error {
+			rec.record("start " + name)
+			time.Sleep(warmup)
+			ready()
+			<-ctx.Done()
+			rec.record("stop " + name)
+			return nil
+		}
+	}
+
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan:      sigs,
+			ShutdownTimeout: time.Second,
+			OnReady:         func() { close(ready) },
+		},
+			runservicerun.WithStartFuncPriority("worker", 2, worker("worker", 0)),
+			runservicerun.WithStartFuncPriority("metrics", 1, worker("metrics", 50*time.Millisecond)),
+		)
+	}()
+
+	<-ready
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if have, want := strings.Join(rec.order, ","), "start metrics,start worker,stop worker,stop metrics"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoWithReloadableTLS(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first")
+
+	logBuf := &mutextBuffer{}
+	sigs := make(chan os.Signal)
+	addrs := make(chan net.Addr, 1)
+	reloaded := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			LogError:   logBuf.log,
+			LogInfo:    logBuf.log,
+			OnListen:   func(_ string, addr net.Addr) { addrs <- addr },
+			// called after the reloadable certificates
+			OnReload: func() error {
+				close(reloaded)
+				return nil
+			},
+		},
+			runservicerun.WithReloadableTLS("127.0.0.1:0", certFile, keyFile, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+	}()
+	addr := (<-addrs).String()
+
+	servedCN := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if have, want := servedCN(), "first"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	writeCert(t, certFile, keyFile, "second")
+	sigs <- syscall.SIGHUP
+	<-reloaded
+	if have, want := servedCN(), "second"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoOnEvent(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	var mu sync.Mutex
+	events := map[string][]string{}
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnReady:    func() { close(ready) },
+			OnEvent: func(evt runservicerun.Event) {
+				mu.Lock()
+				events[evt.Name] = append(events[evt.Name], evt.Type.String())
+				mu.Unlock()
+			},
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+			runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
+		)
+	}()
+
+	<-ready
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; !errors.Is(err, errCloseAfter) {
+		t.Fatalf("expected errCloseAfter, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, want := range map[string]string{
+		"127.0.0.1:0": "Started,ShutdownBegin,ShutdownComplete",
+		"testCloserA": "ShutdownBegin,Error",
+	} {
+		if have := strings.Join(events[name], ","); have != want {
+			t.Errorf("%s\nHave: %s\nWant: %s", name, have, want)
+		}
+	}
+}
+
+func TestGoLogger(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal)
+	buf := new(mutextBuffer)
+	ready := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnReady:    func() { close(ready) },
+			Logger:     slog.New(slog.NewJSONHandler(buf, nil)),
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+			runservicerun.WithCloserBefore("testCloserB", closeErr{err: errCloseBefore}),
+		)
+	}()
+
+	<-ready
+	sigs <- syscall.SIGUSR1
+	if err := <-goErr; !errors.Is(err, errCloseBefore) {
+		t.Fatalf("expected errCloseBefore, got: %v", err)
+	}
+
+	var lines []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		m := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("%s: %s", err, line)
+		}
+		lines = append(lines, m)
+	}
+	for _, want := range []map[string]string{
+		{"level": "INFO", runservicerun.LogKeyPhase: runservicerun.LogPhaseStart, runservicerun.LogKeyService: "127.0.0.1:0", runservicerun.LogKeyAddr: "127.0.0.1:0"},
+		{"level": "ERROR", runservicerun.LogKeyPhase: runservicerun.LogPhaseCloseBefore, runservicerun.LogKeyService: "testCloserB", runservicerun.LogKeyErr: errCloseBefore.Error()},
+		{"level": "INFO", runservicerun.LogKeyPhase: runservicerun.LogPhaseShutdown, runservicerun.LogKeyService: "127.0.0.1:0", "msg": "shutting down server 127.0.0.1:0"},
+	} {
+		if !containsLogLine(lines, want) {
+			t.Errorf("missing log line %v in:\n%s", want, buf)
+		}
+	}
+}
+
+func containsLogLine(lines []map[string]string, want map[string]string) bool {
+	for _, line := range lines {
+		found := true
+		for k, v := range want {
+			if line[k] != v {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRunner(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var addr net.Addr
+	stopped := make(chan struct{})
+	r := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})),
+		runservicerun.WithStartStopFunc("worker", func() error {
+			<-stopped
+			return nil
+		}, func(context.Context) error {
+			close(stopped)
+			return nil
+		}),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(context.Background()); err == nil {
+		t.Error("expected an error when starting twice")
+	}
+
+	resp, err := http.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if have, want := resp.StatusCode, http.StatusTeapot; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for name, sr := range r.Report().Services {
+		if !sr.Started || !sr.Stopped || sr.Err != nil {
+			t.Errorf("%s: %+v", name, sr)
+		}
+	}
+}
+
+func TestRunnerStartListenError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandler(lis.Addr().String(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	if err := r.Start(context.Background()); err == nil {
+		t.Fatal("expected a listen error")
+	}
+	select {
+	case <-r.Done():
+	default:
+		t.Error("expected the runner to be done")
+	}
+}
+
+func TestRunnerListenFunc(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	errInjected := errors.New("injected bind failure")
+	var listened []string
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ListenFunc: func(network, addr string) (net.Listener, error) {
+			listened = append(listened, network+" "+addr)
+			if addr == "127.0.0.1:7" {
+				return nil, errInjected
+			}
+			return net.Listen(network, addr)
+		},
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithHTTPHandler("127.0.0.1:7", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	if err := r.Start(context.Background()); !errors.Is(err, errInjected) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have, want := strings.Join(listened, ","), "tcp 127.0.0.1:0,tcp 127.0.0.1:7"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestRunnerListenConfig(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	var mu sync.Mutex
+	var controlled []string
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ListenConfig: &net.ListenConfig{
+			KeepAlive: time.Minute,
+			Control: func(network, _ string, _ syscall.RawConn) error {
+				mu.Lock()
+				defer mu.Unlock()
+				controlled = append(controlled, network)
+				return nil
+			},
+		},
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithHTTPHandlerReusePort("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithHTTPUnixSocket(filepath.Join(t.TempDir(), "test.sock"), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(controlled, ","), "tcp4,tcp4,unix"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+}
+
+func TestGoTriggerShutdown(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	logBuf := &mutextBuffer{}
+	trigger := make(chan struct{})
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			Signals:         []os.Signal{syscall.SIGUSR1},
+			LogError:        logBuf.log,
+			LogInfo:         logBuf.log,
+			OnReady:         func() { close(trigger) },
+			TriggerShutdown: trigger,
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+	}()
+
+	select {
+	case err := <-goErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown has not been triggered")
+	}
+	if have := strings.Count(logBuf.String(), "shutdown triggered"); have != 1 {
+		t.Errorf("expected one trigger log line, have %d:\n%s", have, logBuf)
+	}
+}
+
+func TestGoOnSignal(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	sigs := make(chan os.Signal, 1)
+	var shutdownBegun atomic.Bool
+	var received os.Signal
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			SignalChan: sigs,
+			OnReady:    func() { sigs <- syscall.SIGINT },
+			OnSignal: func(sig os.Signal) {
+				if shutdownBegun.Load() {
+					t.Error("OnSignal called after the shutdown began")
+				}
+				received = sig
+			},
+			OnEvent: func(evt runservicerun.Event) {
+				if evt.Type == runservicerun.EventShutdownBegin {
+					shutdownBegun.Store(true)
+				}
+			},
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		)
+	}()
+
+	select {
+	case err := <-goErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Go did not return after the signal")
+	}
+	if received != syscall.SIGINT {
+		t.Errorf("\nHave: %v\nWant: %v", received, syscall.SIGINT)
+	}
+}
+
+func TestGoShutdownReportPath(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	dir := t.TempDir()
+	for _, test := range []struct {
+		path    string
+		wantLog string
+	}{
+		{path: filepath.Join(dir, "report.json")},
+		{path: filepath.Join(dir, "missing", "report.json"), wantLog: "failed to write the shutdown report with error"},
+	} {
+		logBuf := &mutextBuffer{}
+		sigs := make(chan os.Signal, 1)
+		err := runservicerun.Go(runservicerun.Options{
+			LogError:           logBuf.log,
+			LogInfo:            logBuf.log,
+			SignalChan:         sigs,
+			OnReady:            func() { sigs <- syscall.SIGUSR1 },
+			ShutdownReportPath: test.path,
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+			runservicerun.WithCloserAfter("testCloserA", closeErr{err: errCloseAfter}),
+		)
+		if !errors.Is(err, errCloseAfter) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if test.wantLog != "" {
+			checkLog(t, logBuf, test.wantLog)
+			continue
+		}
+
+		b, err := os.ReadFile(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report struct {
+			Error    string `json:"error"`
+			Services map[string]struct {
+				Stopped          bool   `json:"stopped"`
+				Error            string `json:"error"`
+				ShutdownDuration string `json:"shutdown_duration"`
+			} `json:"services"`
+		}
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Error == "" || report.Services["testCloserA"].Error != errCloseAfter.Error() {
+			t.Errorf("missing errors in report:\n%s", b)
+		}
+		if srv := report.Services["127.0.0.1:0"]; !srv.Stopped || srv.ShutdownDuration == "" {
+			t.Errorf("unexpected server report:\n%s", b)
+		}
+	}
+}
+
+func TestGoCanceledContext(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var listened, started, finalized bool
+	err := runservicerun.Go(runservicerun.Options{
+		Context:  ctx,
+		OnListen: func(string, net.Addr) { listened = true },
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		runservicerun.WithPreStart("migrate", func(context.Context) error {
+			started = true
+			return nil
+		}),
+		runservicerun.WithFinalizer("flush", func() error {
+			finalized = true
+			return nil
+		}),
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if listened || started {
+		t.Error("services started with a canceled context")
+	}
+	if !finalized {
+		t.Error("finalizer not called with a canceled context")
+	}
+}
+
+func TestGoDisableSignals(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	// the test's registration keeps SIGUSR1 from terminating the process
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan struct{})
+	var closed atomic.Bool
+	goErr := make(chan error)
+	go func() {
+		goErr <- runservicerun.Go(runservicerun.Options{
+			Context:        ctx,
+			Signals:        []os.Signal{syscall.SIGUSR1},
+			DisableSignals: true,
+			OnReady:        func() { close(ready) },
+		},
+			runservicerun.WithHTTPHandler("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+			runservicerun.WithCloserAfter("testCloserA", closerFunc(func() error {
+				closed.Store(true)
+				return nil
+			})),
+		)
+	}()
+	<-ready
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	<-sigs
+	select {
+	case err := <-goErr:
+		t.Fatalf("Go reacted to a signal: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-goErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !closed.Load() {
+		t.Error("graceful shutdown did not run the closer")
+	}
+}
+
+func TestGoNoServices(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	if err := runservicerun.Go(runservicerun.Options{}); !errors.Is(err, runservicerun.ErrNoServices) {
+		t.Fatalf("expected ErrNoServices, got: %v", err)
+	}
+
+	// a pre-start function or a finalizer alone is a service
+	var finalized atomic.Bool
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGUSR1
+	err := runservicerun.Go(runservicerun.Options{SignalChan: sigs},
+		runservicerun.WithPreStart("migrate", func(context.Context) error { return nil }),
+		runservicerun.WithFinalizer("flush", func() error {
+			finalized.Store(true)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !finalized.Load() {
+		t.Error("finalizer not called")
+	}
+
+	sigs, done := make(chan os.Signal, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := runservicerun.Go(runservicerun.Options{SignalChan: sigs, AllowNoServices: true}); err != nil {
+			t.Error(err)
+		}
+	}()
+	signalAndCheckLog(t, sigs, done, &mutextBuffer{})
+}
+
+func TestGoWithHTTPHandlerReusePort(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, name) })
+	}
+	var addr string
+	r1 := runservicerun.NewRunner(runservicerun.Options{
+		OnListen: func(_ string, a net.Addr) { addr = a.String() },
+	},
+		runservicerun.WithHTTPHandlerReusePort("127.0.0.1:0", handler("r1")),
+	)
+	if err := r1.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the second runner binds the port chosen for the first one
+	r2 := runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandlerReusePort(addr, handler("r2")),
+	)
+	if err := r2.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the port keeps serving after one of the processes stopped
+	if err := r1.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if have, want := string(body), "r2"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	if err := r2.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoDuplicateAddress(t *testing.T) {
+	nullHandler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	err := runservicerun.Go(runservicerun.Options{},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", nullHandler),
+		runservicerun.WithHTTPHandler("127.0.0.1:0", nullHandler),
+		runservicerun.WithHTTPHandler("127.0.0.1:7878", nullHandler),
+		runservicerun.WithHTTPServer(&http.Server{Addr: "127.0.0.1:7878", Handler: nullHandler}),
+	)
+	if !errors.Is(err, runservicerun.ErrDuplicateAddress) {
+		t.Fatalf("expected ErrDuplicateAddress, got: %v", err)
+	}
+	if have, want := err.Error(), `duplicate address "127.0.0.1:7878" configured by "127.0.0.1:7878" and "127.0.0.1:7878"`; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	// a wildcard host conflicts with any host on the same port
+	for _, addrs := range [][2]string{
+		{":7878", "127.0.0.1:7878"},
+		{"127.0.0.1:7878", "0.0.0.0:7878"},
+		{"[::]:7878", "localhost:7878"},
+		{"[::1]:7878", "[0:0::1]:7878"},
+		{"LOCALHOST:7878", "localhost:7878"},
+	} {
+		err := runservicerun.Go(runservicerun.Options{},
+			runservicerun.WithHTTPHandler(addrs[0], nullHandler),
+			runservicerun.WithHTTPHandler(addrs[1], nullHandler),
+		)
+		if !errors.Is(err, runservicerun.ErrDuplicateAddress) {
+			t.Errorf("%q: expected ErrDuplicateAddress, got: %v", addrs, err)
+		}
+	}
+}
+
+func TestDefaultSignals(t *testing.T) {
+	for _, sig := range runservicerun.DefaultSignals() {
+		if sig == syscall.SIGKILL {
+			t.Fatalf("default signals must not contain %s", sig)
+		}
+	}
+}
+
+func TestRunnerShutdownTimeoutError(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	release := make(chan struct{})
+	var inFlight sync.WaitGroup
+	inFlight.Add(2)
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		inFlight.Done()
+		<-release // never finishes draining within the timeout
+	})
+	var mu sync.Mutex
+	var addrs []string
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ShutdownTimeout: 50 * time.Millisecond,
+		OnListen: func(_ string, addr net.Addr) {
+			mu.Lock()
+			addrs = append(addrs, addr.String())
+			mu.Unlock()
+		},
+	},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", handler),
+		runservicerun.WithHTTPHandler("127.0.0.1:0", handler),
+		runservicerun.WithCloserAfterContext("flush", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	)
+	if _, err := r.StartAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	var clients sync.WaitGroup
+	for _, addr := range addrs {
+		clients.Add(1)
+		go func(addr string) {
+			defer clients.Done()
+			if resp, err := client.Get("http://" + addr); err == nil {
+				resp.Body.Close()
+			}
+		}(addr)
+	}
+	inFlight.Wait()
+
+	err := r.Stop(context.Background())
+	close(release)
+	clients.Wait()
+
+	if have, want := fmt.Sprint(err), "shutdown timed out after 50ms, force-closed 2 servers, 1 service timed out"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	var te *runservicerun.ShutdownTimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected a ShutdownTimeoutError, got: %#v", err)
+	}
+	if have, want := strings.Join(te.TimedOut, ","), "flush"; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, runservicerun.ErrShutdown) {
+		t.Errorf("expected the service errors to be wrapped: %v", err)
+	}
+	if have, want := runservicerun.ExitCode(err), runservicerun.ExitCodeShutdownTimeout; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+func TestRunnerShutdownTimeoutErrorEffectiveTimeout(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 600*time.Millisecond)()
+
+	release := make(chan struct{})
+	inFlight := make(chan struct{})
+	var addr string
+	r := runservicerun.NewRunner(runservicerun.Options{
+		ShutdownTimeout: 20 * time.Millisecond,
+		OnListen:        func(_ string, a net.Addr) { addr = a.String() },
+	},
+		runservicerun.WithHTTPHandlerTimeout("127.0.0.1:0", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			close(inFlight)
+			<-release
+		}), 80*time.Millisecond),
+		runservicerun.WithCloserAfterContext("broken", func(context.Context) error {
+			return errors.New("broken pipe")
+		}),
+	)
+	if _, err := r.StartAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get("http://" + addr); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-inFlight
+
+	err := r.Stop(context.Background())
+	close(release)
+	<-done
+
+	if have, want := fmt.Sprint(err), `shutdown timed out after 80ms, force-closed 1 server: service "broken": broken pipe`; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+
+	// a deadline of the closer itself is no shutdown timeout
+	r = runservicerun.NewRunner(runservicerun.Options{},
+		runservicerun.WithHTTPHandler("127.0.0.1:0", http.NotFoundHandler()),
+		runservicerun.WithCloserAfterContext("flush", func(context.Context) error {
+			return fmt.Errorf("flush: %w", context.DeadlineExceeded)
+		}),
+	)
+	if _, err := r.StartAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Stop(context.Background())
+	if have, want := fmt.Sprint(err), `service "flush": flush: context deadline exceeded`; have != want {
+		t.Errorf("\nHave: %s\nWant: %s", have, want)
+	}
+	if have, want := runservicerun.ExitCode(err), 1; have != want {
+		t.Errorf("\nHave: %d\nWant: %d", have, want)
+	}
+}
+
+// signalAndCheckLog sends a shutdown signal and checks the log once Go has
+// returned.
+func signalAndCheckLog(t *testing.T, sigs chan<- os.Signal, done <-chan struct{}, logStr fmt.Stringer, wantLogLines ...string) {
+	sigs <- syscall.SIGUSR1
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Go did not return after the signal")
+	}
+	checkLog(t, logStr, wantLogLines...)
+}
+
+func checkLog(t *testing.T, logStr fmt.Stringer, wantLogLines ...string) {
 	t.Log(logStr)
 	for _, l := range wantLogLines {
 		if !strings.Contains(logStr.String(), l) {
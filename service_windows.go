@@ -0,0 +1,100 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package runservicerun
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// startWindowsService reports, when the process runs as a Windows service, the
+// state of Go to the Service Control Manager and forwards its stop and
+// shutdown requests as os.Interrupt to sigChan. The returned function reports
+// the service as stopped and must be called once Go returns.
+func startWindowsService(opt *Options, sigChan chan<- os.Signal) func() {
+	if opt.WindowsServiceName == "" {
+		return func() {}
+	}
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		logError(*opt, logAttrs(LogPhaseStart, opt.WindowsServiceName, "", err), "failed to detect Windows service with error: %s", err)
+		return func() {}
+	}
+	if !isService {
+		return func() {}
+	}
+
+	h := &scmHandler{
+		sigChan: sigChan,
+		running: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	onReady := opt.OnReady
+	opt.OnReady = func() {
+		close(h.running)
+		if onReady != nil {
+			onReady()
+		}
+	}
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- svc.Run(opt.WindowsServiceName, h)
+	}()
+	name, logOpt := opt.WindowsServiceName, *opt
+	return func() {
+		close(h.stopped)
+		if err := <-runErr; err != nil {
+			logError(logOpt, logAttrs(LogPhaseShutdown, name, "", err), "Windows service %q failed with error: %s", name, err)
+		}
+	}
+}
+
+// scmHandler implements svc.Handler.
+type scmHandler struct {
+	sigChan chan<- os.Signal
+	running chan struct{}
+	stopped chan struct{}
+}
+
+func (h *scmHandler) Execute(_ []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	s <- svc.Status{State: svc.StartPending}
+	running := h.running
+	for {
+		select {
+		case <-running:
+			running = nil
+			s <- svc.Status{State: svc.Running, Accepts: accepts}
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				select {
+				case h.sigChan <- os.Interrupt:
+				default:
+				}
+			}
+		case <-h.stopped:
+			s <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShutdownStep identifies a step of the shutdown, see Options.ShutdownOrder.
+type ShutdownStep int
+
+// The steps of the shutdown.
+const (
+	// StepClosersBefore calls the closers of WithCloserBefore and
+	// WithCloserBeforeContext in registration order.
+	StepClosersBefore ShutdownStep = iota + 1
+	// StepServers shuts down all servers concurrently and, alongside, the
+	// servers and closers of WithShutdownSequence in reverse order, those of
+	// WithDependsOn in dependency order and the closers of WithCloserDuring.
+	StepServers
+	// StepStopFuncs calls the stop functions of WithStartStopFunc and
+	// WithPacketConn concurrently and stops the functions of
+	// WithStartFuncPriority in reverse priority order.
+	StepStopFuncs
+	// StepClosersAfter calls the closers of WithCloserAfter and
+	// WithCloserAfterContext in registration order.
+	StepClosersAfter
+	// StepClosersAfterConcurrent calls the closers of
+	// WithCloserAfterConcurrent concurrently.
+	StepClosersAfterConcurrent
+)
+
+func (s ShutdownStep) String() string {
+	switch s {
+	case StepClosersBefore:
+		return "ClosersBefore"
+	case StepServers:
+		return "Servers"
+	case StepStopFuncs:
+		return "StopFuncs"
+	case StepClosersAfter:
+		return "ClosersAfter"
+	case StepClosersAfterConcurrent:
+		return "ClosersAfterConcurrent"
+	}
+	return "ShutdownStep(" + strconv.Itoa(int(s)) + ")"
+}
+
+// DefaultShutdownOrder returns the order used when Options.ShutdownOrder is
+// empty: closers before, then servers and stop functions concurrently, then
+// closers after and finally concurrent closers after.
+func DefaultShutdownOrder() [][]ShutdownStep {
+	return [][]ShutdownStep{
+		{StepClosersBefore},
+		{StepServers, StepStopFuncs},
+		{StepClosersAfter},
+		{StepClosersAfterConcurrent},
+	}
+}
+
+// validateShutdownOrder checks that each step appears exactly once.
+func validateShutdownOrder(order [][]ShutdownStep) error {
+	seen := map[ShutdownStep]bool{}
+	for _, group := range order {
+		for _, step := range group {
+			if step < StepClosersBefore || step > StepClosersAfterConcurrent {
+				return fmt.Errorf("invalid shutdown step %s", step)
+			}
+			if seen[step] {
+				return fmt.Errorf("shutdown step %s listed twice", step)
+			}
+			seen[step] = true
+		}
+	}
+	for step := StepClosersBefore; step <= StepClosersAfterConcurrent; step++ {
+		if !seen[step] {
+			return fmt.Errorf("shutdown step %s missing", step)
+		}
+	}
+	return nil
+}
+
+// shutdown runs the steps in the order of Options.ShutdownOrder. The errors
+// get returned in step order, summarized by a ShutdownTimeoutError when the
+// shutdown did not complete in time.
+func (r *Runner) shutdown(ctx context.Context, prioGroups []*prioGroup) []error {
+	var errs []error
+	r.skippedClosers.Store(0)
+	for _, group := range r.opt.ShutdownOrder {
+		results := make([][]error, len(group))
+		for _, step := range group {
+			r.phase(step.phase())
+		}
+		var wg sync.WaitGroup
+		for i, step := range group {
+			wg.Add(1)
+			go func(i int, step ShutdownStep) {
+				defer wg.Done()
+				results[i] = r.shutdownStep(ctx, step, prioGroups)
+			}(i, step)
+		}
+		wg.Wait()
+		for _, res := range results {
+			errs = append(errs, res...)
+		}
+	}
+	if r.budgetExceeded() {
+		errs = append(errs, ErrMaxShutdownDuration)
+	}
+	if te := r.timeoutError(errs); te != nil {
+		return []error{te}
+	}
+	return errs
+}
+
+// ShutdownTimeoutError summarizes a shutdown which did not complete within
+// Options.ShutdownTimeout or Options.MaxShutdownDuration. It unwraps to the
+// errors of the services.
+type ShutdownTimeoutError struct {
+	// Timeout is the longest timeout exceeded by a service, which honours
+	// WithHTTPHandlerTimeout and Options.CloserTimeout, or
+	// Options.MaxShutdownDuration when that one has been exceeded.
+	Timeout time.Duration
+	// ForceClosed lists the servers closed after failing to drain in time.
+	ForceClosed []string
+	// TimedOut lists the closers and stop functions which did not return in
+	// time.
+	TimedOut []string
+	// Skipped counts the closers not called at all because
+	// Options.MaxShutdownDuration has been exceeded.
+	Skipped int
+	Errs    []error
+}
+
+func (te *ShutdownTimeoutError) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "shutdown timed out after %s", te.Timeout)
+	if n := len(te.ForceClosed); n > 0 {
+		fmt.Fprintf(&buf, ", force-closed %d %s", n, plural(n, "server"))
+	}
+	if n := len(te.TimedOut); n > 0 {
+		fmt.Fprintf(&buf, ", %d %s timed out", n, plural(n, "service"))
+	}
+	if te.Skipped > 0 {
+		fmt.Fprintf(&buf, ", %d %s skipped", te.Skipped, plural(te.Skipped, "closer"))
+	}
+	sep := ": "
+	for _, err := range te.Errs {
+		if _, _, ok := timedOut(err); ok || errors.Is(err, ErrMaxShutdownDuration) {
+			continue
+		}
+		buf.WriteString(sep)
+		buf.WriteString(err.Error())
+		sep = "; "
+	}
+	return buf.String()
+}
+
+func (te *ShutdownTimeoutError) Unwrap() []error {
+	return te.Errs
+}
+
+func plural(n int, s string) string {
+	if n == 1 {
+		return s
+	}
+	return s + "s"
+}
+
+// timeoutExceeded marks the error of a service whose shutdown context expired
+// after timeout.
+type timeoutExceeded struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *timeoutExceeded) Error() string { return e.err.Error() }
+
+func (e *timeoutExceeded) Unwrap() error { return e.err }
+
+// exceeded marks err as a timeout when ctx, limited by timeout, has expired.
+// A context.DeadlineExceeded of the service itself stays a plain error.
+func exceeded(ctx context.Context, timeout time.Duration, err error) error {
+	if timeout > 0 && errors.Is(err, context.DeadlineExceeded) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutExceeded{timeout: timeout, err: err}
+	}
+	return err
+}
+
+// timedOut returns the ServiceError of a service which did not shut down in
+// time and the exceeded timeout.
+func timedOut(err error) (*ServiceError, time.Duration, bool) {
+	var se *ServiceError
+	var te *timeoutExceeded
+	if !errors.As(err, &se) || !errors.As(se.Err, &te) {
+		return nil, 0, false
+	}
+	return se, te.timeout, true
+}
+
+// timeoutError returns a ShutdownTimeoutError summarizing errs when a service
+// did not shut down in time or the shutdown budget has been exceeded,
+// otherwise nil.
+func (r *Runner) timeoutError(errs []error) *ShutdownTimeoutError {
+	te := &ShutdownTimeoutError{
+		Skipped: int(r.skippedClosers.Load()),
+		Errs:    errs,
+	}
+	servers := map[string]bool{}
+	for _, srv := range r.srvs.servers {
+		servers[srv.name] = true
+	}
+	for _, err := range errs {
+		se, timeout, ok := timedOut(err)
+		if !ok {
+			continue
+		}
+		if servers[se.Name] {
+			te.ForceClosed = append(te.ForceClosed, se.Name)
+		} else {
+			te.TimedOut = append(te.TimedOut, se.Name)
+		}
+		if timeout > te.Timeout {
+			te.Timeout = timeout
+		}
+	}
+	if r.budgetExceeded() {
+		te.Timeout = r.opt.MaxShutdownDuration
+	} else if len(te.ForceClosed) == 0 && len(te.TimedOut) == 0 {
+		return nil
+	}
+	return te
+}
+
+// closerOrder returns the closers in the order to close them, reversed with
+// Options.ShutdownLIFO.
+func (r *Runner) closerOrder(closers []named) []named {
+	if !r.opt.ShutdownLIFO {
+		return closers
+	}
+	rev := make([]named, len(closers))
+	for i, c := range closers {
+		rev[len(closers)-1-i] = c
+	}
+	return rev
+}
+
+// stepClosers returns the closers called by the step.
+func (r *Runner) stepClosers(step ShutdownStep) []named {
+	switch step {
+	case StepClosersBefore:
+		return r.srvs.closersBefore
+	case StepClosersAfter:
+		return r.srvs.closersAfter
+	case StepClosersAfterConcurrent:
+		return r.srvs.closersAfterConcurrent
+	}
+	return nil
+}
+
+// shutdownStep runs the step. Once Options.MaxShutdownDuration has elapsed,
+// the closers get skipped while the servers still get closed and the stop
+// functions called, both with a canceled context, so that their go routines
+// return.
+func (r *Runner) shutdownStep(ctx context.Context, step ShutdownStep, prioGroups []*prioGroup) []error {
+	if r.budgetExceeded() && step != StepServers && step != StepStopFuncs {
+		logError(r.opt, logAttrs(LogPhaseShutdown, "", "", ErrMaxShutdownDuration), "skipping shutdown step %s", step)
+		r.skippedClosers.Add(int32(len(r.stepClosers(step))))
+		return nil
+	}
+	switch step {
+	case StepClosersBefore:
+		return closeAll(ctx, r.opt, r.rep, PhaseClosersBefore, LogPhaseCloseBefore, "closing before", r.closerOrder(r.srvs.closersBefore))
+	case StepServers:
+		return r.shutdownServersStep(ctx)
+	case StepStopFuncs:
+		return stopStarts(ctx, r.opt, r.rep, r.srvs.starts, prioGroups)
+	case StepClosersAfter:
+		return closeAll(ctx, r.opt, r.rep, PhaseClosersAfter, LogPhaseCloseAfter, "closing after", r.closerOrder(r.srvs.closersAfter))
+	case StepClosersAfterConcurrent:
+		return closeConcurrent(ctx, r.opt, r.rep, PhaseClosersAfterConcurrent, LogPhaseCloseAfter, "closing after concurrently", r.srvs.closersAfterConcurrent)
+	}
+	return nil
+}
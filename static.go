@@ -0,0 +1,57 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// WithStaticFiles serves the files of the directory dir, see http.FileServer.
+// Paths escaping dir get rejected.
+func WithStaticFiles(addr, dir string) Config {
+	return func(s *services) error {
+		s.servers = append(s.servers, newOwnHTTPServer(newHandlerServer(addr, http.FileServer(http.Dir(dir))), "", ""))
+		return nil
+	}
+}
+
+// WithStaticFilesSPA same as WithStaticFiles but serves dir/index.html for all
+// paths not matching a file, as required by single page applications which
+// route on the client side.
+func WithStaticFilesSPA(addr, dir string) Config {
+	return func(s *services) error {
+		s.servers = append(s.servers, newOwnHTTPServer(newHandlerServer(addr, spaHandler(http.Dir(dir))), "", ""))
+		return nil
+	}
+}
+
+func spaHandler(root http.FileSystem) http.Handler {
+	files := http.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := root.Open(path.Clean("/" + r.URL.Path))
+		if errors.Is(err, fs.ErrNotExist) {
+			r = r.Clone(r.Context())
+			r.URL.Path = "/"
+			r.URL.RawPath = ""
+		}
+		if f != nil {
+			_ = f.Close()
+		}
+		files.ServeHTTP(w, r)
+	})
+}
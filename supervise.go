@@ -0,0 +1,64 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WithSupervisedStartFunc starts the function in its own go routine like
+// WithStartFuncContext and restarts it up to maxRestarts times when it fails
+// or panics. The restarts wait backoff, doubled after each restart. Once all
+// restarts have been used up, the last error fails the run. A clean return,
+// see Options.IgnoreErrors, or the beginning of the shutdown ends the
+// supervision.
+func WithSupervisedStartFunc(name string, fn func(context.Context) error, maxRestarts int, backoff time.Duration) Config {
+	return func(s *services) error {
+		if maxRestarts < 0 {
+			return fmt.Errorf("supervised start function %q: negative maxRestarts %d", name, maxRestarts)
+		}
+		s.starts = append(s.starts, named{name: name, startFn: fn, supervise: &supervision{maxRestarts: maxRestarts, backoff: backoff}})
+		return nil
+	}
+}
+
+type supervision struct {
+	maxRestarts int
+	backoff     time.Duration
+}
+
+// wrap returns a start function calling fn and restarting it on failures.
+func (sv *supervision) wrap(opt Options, name string, fn func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		backoff := sv.backoff
+		for restarts := 0; ; restarts++ {
+			err := callStart(ctx, opt, named{name: name, startFn: fn})
+			if cleanExit(opt, err) || ctx.Err() != nil || restarts == sv.maxRestarts {
+				return err
+			}
+			logError(opt, logAttrs(LogPhaseStart, name, "", err), "service %q failed with error: %s, restart %d of %d in %s", name, err, restarts+1, sv.maxRestarts, backoff)
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+			backoff *= 2
+		}
+	}
+}
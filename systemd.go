@@ -0,0 +1,99 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNoSystemdSockets gets returned by WithSystemdSockets when the process has
+// not been started via systemd socket activation.
+var ErrNoSystemdSockets = errors.New("no systemd sockets passed")
+
+// listenFDsStart defines the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// WithSystemdSockets serves the handler on each socket passed by systemd
+// socket activation via the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+// environment variables. The variables get unset so that child processes do
+// not inherit them.
+func WithSystemdSockets(handler http.Handler) Config {
+	return func(s *services) error {
+		listeners, names, err := systemdListeners()
+		if err != nil {
+			return err
+		}
+		for i, lis := range listeners {
+			if err := WithHTTPListener(names[i], lis, handler)(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func systemdListeners() ([]net.Listener, []string, error) {
+	pidEnv, fdsEnv := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pidEnv == "" || fdsEnv == "" {
+		return nil, nil, ErrNoSystemdSockets
+	}
+	pid, err := strconv.Atoi(pidEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid LISTEN_PID %q: %w", pidEnv, err)
+	}
+	if pid != os.Getpid() {
+		return nil, nil, fmt.Errorf("LISTEN_PID %d does not match the current process %d: %w", pid, os.Getpid(), ErrNoSystemdSockets)
+	}
+	nfds, err := strconv.Atoi(fdsEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS %q: %w", fdsEnv, err)
+	}
+	if nfds < 1 {
+		return nil, nil, ErrNoSystemdSockets
+	}
+	fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, nfds)
+	names := make([]string, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fd := listenFDsStart + i
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		lis, err := net.FileListener(f)
+		_ = f.Close() // FileListener duplicates the descriptor
+		if err != nil {
+			for _, lis := range listeners {
+				_ = lis.Close()
+			}
+			return nil, nil, fmt.Errorf("systemd socket fd %d: %w", fd, err)
+		}
+		name := lis.Addr().String()
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		listeners = append(listeners, lis)
+		names = append(names, name)
+	}
+	return listeners, names, nil
+}
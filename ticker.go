@@ -0,0 +1,61 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WithTicker calls fn every interval in its own go routine until the shutdown
+// begins. A running call receives the canceled context and gets waited for, a
+// pending tick gets dropped. An error returned by fn stops the ticker and the
+// run, unless fn returned due to the canceled context. The stopped ticker gets
+// logged via Options.LogInfo.
+func WithTicker(name string, interval time.Duration, fn func(context.Context) error) Config {
+	return func(s *services) error {
+		if interval <= 0 {
+			return fmt.Errorf("ticker %q: interval must be positive, got %s", name, interval)
+		}
+		s.starts = append(s.starts, named{name: name, ticker: true, startFn: func(ctx context.Context) error {
+			return runTicker(ctx, interval, fn)
+		}})
+		return nil
+	}
+}
+
+func runTicker(ctx context.Context, interval time.Duration, fn func(context.Context) error) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		if ctx.Err() != nil {
+			// both channels were ready, the shutdown wins
+			return nil
+		}
+		if err := fn(ctx); err != nil {
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				return nil
+			}
+			return err
+		}
+	}
+}
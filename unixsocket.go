@@ -0,0 +1,119 @@
+// Copyright 2019 Cyrill @ Schumacher.fm
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runservicerun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultUnixSocketMode defines the file permissions of the socket created by
+// WithHTTPUnixSocket.
+const DefaultUnixSocketMode os.FileMode = 0o660
+
+// WithHTTPUnixSocket serves the handler on a Unix domain socket at path and
+// shutdowns it. A stale socket file, which no process listens on, gets
+// removed before binding. The socket file gets removed during shutdown.
+// A path starting with "@" binds a socket in the abstract namespace of Linux,
+// which has no file and therefore neither a mode nor stale files. Other
+// platforms fail with ErrAbstractUnixSocket.
+func WithHTTPUnixSocket(path string, handler http.Handler) Config {
+	return WithHTTPUnixSocketMode(path, DefaultUnixSocketMode, handler)
+}
+
+// WithHTTPUnixSocketMode works like WithHTTPUnixSocket and sets the file
+// permissions of the socket to mode.
+func WithHTTPUnixSocketMode(path string, mode os.FileMode, handler http.Handler) Config {
+	return func(s *services) error {
+		srv := newOwnHTTPServer(&http.Server{Handler: handler}, "", "")
+		srv.name = path
+		srv.addr = path
+		srv.network = "unix"
+		srv.socketMode = mode
+		s.servers = append(s.servers, srv)
+		return nil
+	}
+}
+
+// ErrAbstractUnixSocket gets returned when binding an abstract Unix domain
+// socket on a platform other than Linux.
+var ErrAbstractUnixSocket = errors.New("abstract unix sockets are only supported on Linux")
+
+// isAbstractSocket reports whether path names a socket in the abstract
+// namespace.
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@") || strings.HasPrefix(path, "\x00")
+}
+
+// listenUnix binds the Unix domain socket at path and applies the mode.
+func listenUnix(ctx context.Context, opt Options, path string, mode os.FileMode) (net.Listener, error) {
+	if isAbstractSocket(path) {
+		return listenAbstractUnix(ctx, opt, path)
+	}
+	if err := removeStaleSocket(opt, path); err != nil {
+		return nil, err
+	}
+	lc := opt.listenConfig()
+	lis, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	ul := &unixSocketListener{Listener: lis, path: path}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ul.Close()
+		return nil, err
+	}
+	return ul, nil
+}
+
+// removeStaleSocket removes the socket file at path when no process listens
+// on it anymore.
+func removeStaleSocket(opt Options, path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket %s already in use", path)
+	}
+	logError(opt, logAttrs(LogPhaseStart, path, path, nil), "removing stale socket %q", path)
+	return os.Remove(path)
+}
+
+// unixSocketListener removes the socket file once closed.
+type unixSocketListener struct {
+	net.Listener
+	path string
+}
+
+func (ul *unixSocketListener) Close() error {
+	err := ul.Listener.Close()
+	if rErr := os.Remove(ul.path); rErr != nil && !os.IsNotExist(rErr) && err == nil {
+		err = rErr
+	}
+	return err
+}